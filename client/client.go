@@ -3,62 +3,37 @@
 package client
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/protocol/commands"
 )
 
 const DefaultAddress = "192.168.8.46:8080"
 
-// A Listener is for communicating messages from the vehicle to
-// interested clients.
-type Listener struct {
-	// C has received messages.
-	C    chan *protocol.PhevMessage
-	stop bool
-}
-
-func (l *Listener) Start() {
-	l.stop = false
-	l.C = make(chan *protocol.PhevMessage, 5)
-}
-
-func (l *Listener) Stop() {
-	l.stop = true
-}
+// ErrClosed is returned when the connection to the car has closed, such
+// as by a session or by commands sent after Close.
+var ErrClosed = errors.New("connection closed")
 
-func (l *Listener) Send(m *protocol.PhevMessage) {
-	select {
-	case l.C <- m:
-	default:
-		log.Debug("%PHEV_RECV_LISTENER% message not sent")
-	}
-}
-
-func (l *Listener) ProcessStop() bool {
-	if l.stop {
-		close(l.C)
-		l.stop = false
-		return true
-	}
-	return false
-}
-
-type ModelYear int64
+type ModelYear = protocol.ModelYear
 
 const (
-	ModelYearUnknown ModelYear = iota
-	ModelYear14
-	ModelYear18
-	ModelYear24
+	ModelYearUnknown = protocol.ModelYearUnknown
+	ModelYear14      = protocol.ModelYear14
+	ModelYear18      = protocol.ModelYear18
+	ModelYear24      = protocol.ModelYear24
 )
 
-// A Client is a TCP client to a Phev.
+// A Client is a TCP client to a Phev. A client connects once; after
+// it closes, a new client is needed to connect again.
 type Client struct {
 	// Recv is a channel where incoming messages from the Phev are sent.
 	Recv chan *protocol.PhevMessage
@@ -67,21 +42,50 @@ type Client struct {
 
 	// Settings are settings for the car.
 	Settings *protocol.Settings
+	// State is the vehicle state, updated as registers are received.
+	State *State
 
 	listeners []*Listener
 	lMu       sync.Mutex
+	// lClosed is set once the listener channels have been closed.
+	lClosed bool
 
 	address string
-	conn    net.Conn
-	lastRx  time.Time
-	started chan struct{}
-
-	key *protocol.SecurityKey
-
-	// Keep track of the model year so we can use the correct registers
-	ModelYear ModelYear
-
-	closed bool
+	dial    DialFunc
+	// lastRx is when a message was last received, in Unix nanoseconds.
+	lastRx int64
+
+	key    *protocol.SecurityKey
+	logger protocol.Logger
+
+	// mu guards the connection.
+	mu        sync.Mutex
+	conn      net.Conn
+	decoder   *protocol.Decoder
+	connected bool
+	// The model year announced by the car, to use the correct registers.
+	modelYear ModelYear
+
+	// started is closed when the car sends its start request.
+	started   chan struct{}
+	startOnce sync.Once
+
+	// done is closed by shutdown, ending the client's goroutines, which
+	// wg counts.
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	wg        sync.WaitGroup
+
+	// commands queues register writes for the commander.
+	commands chan *command
+
+	// The car clock drift, from the last time register received.
+	timeMu        sync.Mutex
+	timeDrift     time.Duration
+	timeDriftSeen bool
+	timeSynced    bool
+	timeSyncAbove time.Duration
 
 	// Configurable timeouts
 	tcpReadTimeout  time.Duration
@@ -93,6 +97,10 @@ type Client struct {
 // An Option configures the client.
 type Option func(c *Client)
 
+// A DialFunc opens a connection to the car at address, with network
+// "tcp". The DialContext method of a net.Dialer is one.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
 // AddressOption configures the address to the Phev.
 func AddressOption(address string) func(*Client) {
 	return func(c *Client) {
@@ -100,6 +108,23 @@ func AddressOption(address string) func(*Client) {
 	}
 }
 
+// DialerOption sets the function used to connect to the car, such as
+// to bind a source address or to go through a tunnel. The default is
+// a net.Dialer.
+func DialerOption(dial DialFunc) func(*Client) {
+	return func(c *Client) {
+		c.dial = dial
+	}
+}
+
+// ConnOption makes the client use conn, such as one end of a net.Pipe,
+// rather than dialling. Close closes conn.
+func ConnOption(conn net.Conn) func(*Client) {
+	return DialerOption(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return conn, nil
+	})
+}
+
 // TCPReadTimeoutOption configures the TCP read timeout.
 func TCPReadTimeoutOption(timeout time.Duration) func(*Client) {
 	return func(c *Client) {
@@ -128,169 +153,341 @@ func RegisterTimeoutOption(timeout time.Duration) func(*Client) {
 	}
 }
 
+// TimeSyncOption enables setting the car clock on connect, if it is
+// more than threshold from local time. Zero, the default, disables it.
+func TimeSyncOption(threshold time.Duration) func(*Client) {
+	return func(c *Client) {
+		c.timeSyncAbove = threshold
+	}
+}
+
+// StateOption sets the State updated by the client, so that it can be
+// kept across connections.
+func StateOption(s *State) func(*Client) {
+	return func(c *Client) {
+		c.State = s
+	}
+}
+
+// LoggerOption configures the logger for protocol debug output. The
+// default is the logrus standard logger.
+func LoggerOption(logger protocol.Logger) func(*Client) {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
 // New returns a new client, not yet connected.
 func New(opts ...Option) (*Client, error) {
 	cl := &Client{
 		Recv:            make(chan *protocol.PhevMessage, 5),
 		Send:            make(chan *protocol.PhevMessage, 5),
 		Settings:        &protocol.Settings{},
-		started:         make(chan struct{}, 2),
+		State:           NewState(),
+		started:         make(chan struct{}),
+		done:            make(chan struct{}),
+		commands:        make(chan *command),
 		listeners:       []*Listener{},
 		address:         DefaultAddress,
+		dial:            (&net.Dialer{}).DialContext,
 		key:             &protocol.SecurityKey{},
-		ModelYear:       ModelYearUnknown,
+		modelYear:       ModelYearUnknown,
 		tcpReadTimeout:  30 * time.Second,
 		tcpWriteTimeout: 15 * time.Second,
 		startTimeout:    20 * time.Second,
 		registerTimeout: 10 * time.Second,
+		logger:          log.StandardLogger(),
 	}
 	for _, o := range opts {
 		o(cl)
 	}
+	cl.key.Logger = cl.logger
 	return cl, nil
 }
 
-// Create and return a new Listener.
-func (c *Client) AddListener() *Listener {
-	c.lMu.Lock()
-	defer c.lMu.Unlock()
-	l := &Listener{}
-	l.Start()
-	c.listeners = append(c.listeners, l)
-	return l
+// Close closes the connection and waits for the client's goroutines to
+// end. Recv, and the channels of listeners not yet removed, are closed.
+// It is safe to call more than once, and from any goroutine.
+func (c *Client) Close() error {
+	c.shutdown()
+	c.wg.Wait()
+	return c.closeErr
 }
 
-func (c *Client) RemoveListener(l *Listener) {
-	newL := []*Listener{}
+// shutdown is the single path ending the client, whether from Close or
+// a read or write failure. It closes done, so that the client's
+// goroutines return, and the connection, which releases the reader.
+// Listeners blocked in Send are released too.
+func (c *Client) shutdown() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		close(c.done)
+		conn, connected := c.conn, c.connected
+		c.mu.Unlock()
+		if conn != nil {
+			c.closeErr = conn.Close()
+		}
+		c.lMu.Lock()
+		for _, l := range c.listeners {
+			l.detach()
+		}
+		c.lMu.Unlock()
+		if !connected {
+			// There is no reader to close them.
+			c.closeListeners()
+		}
+	})
+}
+
+// closeListeners closes Recv and the listener channels, once nothing
+// more will be sent on them.
+func (c *Client) closeListeners() {
 	c.lMu.Lock()
 	defer c.lMu.Unlock()
-	for _, lis := range c.listeners {
-		if lis != l {
-			newL = append(newL, lis)
-		}
+	for _, l := range c.listeners {
+		close(l.C)
 	}
-	c.listeners = newL
+	c.listeners = nil
+	c.lClosed = true
+	close(c.Recv)
 }
 
-// Close closes the client.
-func (c *Client) Close() error {
-	c.closed = true
-	if c.conn == nil {
-		return nil
+// closing returns whether shutdown has started.
+func (c *Client) closing() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
 	}
-	return c.conn.Close()
 }
 
 // Connect connects to the Phev.
 func (c *Client) Connect() error {
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext connects to the Phev. The context only applies to
+// establishing the connection.
+func (c *Client) ConnectContext(ctx context.Context) error {
+	if c.closing() {
+		return ErrClosed
+	}
 	log.Infof("[TCP Connect] Attempting TCP connection to %s", c.address)
-	conn, err := net.Dial("tcp", c.address)
+	conn, err := c.dial(ctx, "tcp", c.address)
 	if err != nil {
 		log.Infof("[TCP Connect] Connection failed: %v", err)
 		return err
 	}
+	c.mu.Lock()
+	switch {
+	case c.closing():
+		err = ErrClosed
+	case c.connected:
+		err = fmt.Errorf("client already connected")
+	}
+	if err != nil {
+		c.mu.Unlock()
+		conn.Close()
+		return err
+	}
 	log.Infof("[TCP Connect] TCP connection established to %s", c.address)
 	log.Infof("[TCP Timeouts] Read: %v, Write: %v, Start: %v, Register: %v", c.tcpReadTimeout, c.tcpWriteTimeout, c.startTimeout, c.registerTimeout)
 	log.Info("%PHEV_TCP_CONNECTED%")
-	c.closed = false
+	c.connected = true
 	c.conn = conn
+	c.decoder = protocol.NewDecoder(conn, c.key)
+	c.decoder.OnResync = func(e protocol.ResyncEvent) {
+		log.Debugf("%%PHEV_TCP_RESYNC%%: %s", e)
+	}
+	c.decoder.OnError = func(err error) {
+		log.Debugf("%%PHEV_TCP_DECODE_ERROR%%: %v", err)
+	}
+	c.wg.Add(5)
+	c.mu.Unlock()
 	go c.reader()
 	go c.writer()
 	go c.manage()
 	go c.pinger()
+	go c.commander()
 
 	return nil
 }
 
+// connectedNow returns whether Connect has succeeded.
+func (c *Client) connectedNow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+// ModelYear returns the model year announced by the car, or
+// ModelYearUnknown until the client has started.
+func (c *Client) ModelYear() ModelYear {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.modelYear
+}
+
+// Health returns the count of messages and decode errors on the
+// current connection.
+func (c *Client) Health() protocol.Health {
+	c.mu.Lock()
+	d := c.decoder
+	c.mu.Unlock()
+	if d == nil {
+		return protocol.Health{}
+	}
+	return d.Health()
+}
+
 // Start waits for the client to start.
 func (c *Client) Start() error {
+	return c.StartContext(context.Background())
+}
+
+// StartContext waits for the client to start, until the start timeout
+// or ctx is done.
+func (c *Client) StartContext(ctx context.Context) error {
 	log.Infof("[PHEV Start] Waiting for start handshake (timeout: %v)", c.startTimeout)
 	log.Debug("%%PHEV_START_AWAIT%%")
-	startTimer := time.After(c.startTimeout)
-	for {
-		select {
-		case _, ok := <-c.started:
-			if !ok {
-				log.Info("[PHEV Start] Start channel closed unexpectedly")
-				log.Debug("%%PHEV_START_CLOSED%%")
-				return fmt.Errorf("receiver closed before getting start request")
-			}
-			log.Info("[PHEV Start] Start handshake completed successfully")
-			log.Debug("%%PHEV_START_DONE%%")
-		case <-startTimer:
-			log.Infof("[PHEV Start] Start handshake TIMED OUT after %v", c.startTimeout)
-			log.Debug("%%PHEV_START_TIMEOUT%%")
-			return fmt.Errorf("timed out waiting for start")
-		}
+	startTimer := time.NewTimer(c.startTimeout)
+	defer startTimer.Stop()
+	select {
+	case <-c.done:
+		log.Info("[PHEV Start] Connection closed before start")
+		log.Debug("%%PHEV_START_CLOSED%%")
+		return fmt.Errorf("receiver closed before getting start request")
+	case <-c.started:
+		log.Info("[PHEV Start] Start handshake completed successfully")
+		log.Debug("%%PHEV_START_DONE%%")
 		return nil
+	case <-startTimer.C:
+		log.Infof("[PHEV Start] Start handshake TIMED OUT after %v", c.startTimeout)
+		log.Debug("%%PHEV_START_TIMEOUT%%")
+		return fmt.Errorf("timed out waiting for start")
+	case <-ctx.Done():
+		log.Infof("[PHEV Start] Start handshake cancelled: %v", ctx.Err())
+		return ctx.Err()
 	}
 }
 
 // SetRegister sets a register on the car.
 func (c *Client) SetRegister(register byte, value []byte) error {
-	setRegister := func(xor byte) {
-		c.Send <- &protocol.PhevMessage{
-			Type:     protocol.CmdOutSend,
-			Ack:      protocol.Request,
-			Register: register,
-			Data:     value,
-			Xor:      xor,
-		}
+	return c.SetRegisterContext(context.Background(), register, value)
+}
+
+// SetRegisterContext sets a register on the car, waiting for it to be
+// acknowledged until the register timeout or ctx is done.
+func (c *Client) SetRegisterContext(ctx context.Context, register byte, value []byte) error {
+	return c.SetRegisterResult(ctx, register, value).Err
+}
+
+// SyncTime sets the car clock to t.
+func (c *Client) SyncTime(t time.Time) error {
+	return c.SyncTimeContext(context.Background(), t)
+}
+
+// SyncTimeContext sets the car clock to t, waiting for it to be
+// acknowledged as SetRegisterContext.
+func (c *Client) SyncTimeContext(ctx context.Context, t time.Time) error {
+	m, err := commands.SyncTime(t, false)
+	if err != nil {
+		return err
 	}
-	xor := byte(0)
-	timer := time.After(c.registerTimeout)
-	l := c.AddListener()
-	defer c.RemoveListener(l)
-SETREG:
-	setRegister(xor)
-	for {
-		select {
-		case <-timer:
-			return fmt.Errorf("timed out attempting to set register %02x", register)
-		case msg, ok := <-l.C:
-			if !ok {
-				return fmt.Errorf("listener channel closed")
-			}
-			if msg.Type == protocol.CmdInBadEncoding {
-				xor = msg.Data[0]
-				goto SETREG
-			}
-			if msg.Type == protocol.CmdInResp && msg.Ack == protocol.Ack && msg.Register == register {
-				return nil
+	return c.SetRegisterContext(ctx, m.Register, m.Data)
+}
+
+// TimeDrift returns how far the car clock was ahead of local time, or
+// behind if negative, when last reported by the car. It returns false
+// if the car has not reported its clock yet.
+func (c *Client) TimeDrift() (time.Duration, bool) {
+	c.timeMu.Lock()
+	defer c.timeMu.Unlock()
+	return c.timeDrift, c.timeDriftSeen
+}
+
+// checkTime records the drift of the car clock, and sets the clock if
+// the drift is above the TimeSyncOption threshold, once per connection.
+func (c *Client) checkTime(r *protocol.RegisterTime) {
+	drift := r.Drift(time.Now())
+	c.timeMu.Lock()
+	c.timeDrift, c.timeDriftSeen = drift, true
+	set := c.timeSyncAbove > 0 && !c.timeSynced && (drift > c.timeSyncAbove || drift < -c.timeSyncAbove)
+	if set {
+		c.timeSynced = true
+	}
+	c.timeMu.Unlock()
+	log.Debugf("%%PHEV_TIME_DRIFT%%: car clock %s, drift %v", r.Time.Format(time.RFC3339), drift)
+	if !set {
+		return
+	}
+	// Not from manage, which must keep reading messages for the ack.
+	// Adding to the WaitGroup is safe as manage is still counted in it.
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-c.done:
+				cancel()
+			case <-ctx.Done():
 			}
+		}()
+		log.Infof("Car clock is off by %v, setting it", drift)
+		if err := c.SyncTimeContext(ctx, time.Now()); err != nil && !c.closing() {
+			log.Warnf("Setting car clock: %v", err)
+		}
+	}()
+}
 
+// SetSetting changes a single vehicle setting, writing the new value
+// to register 0x0f and then saving it via register 0x0e.
+func (c *Client) SetSetting(id protocol.SettingID, value int) error {
+	msgs, err := protocol.NewSettingMessages(id, value)
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if err := c.SetRegister(m.Register, m.Data); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func (c *Client) nextRecvMsg(deadline time.Time) (*protocol.PhevMessage, error) {
-	timer := time.After(deadline.Sub(time.Now()))
-	for {
-		select {
-		case <-timer:
-			return nil, fmt.Errorf("timed out waiting for message")
-		case m, ok := <-c.Recv:
-			if !ok {
-				return nil, fmt.Errorf("error: receive channel closed")
-			}
-			return m, nil
-		}
+// send queues a message for the writer, returning false if the client
+// closes first.
+func (c *Client) send(m *protocol.PhevMessage) bool {
+	select {
+	case c.Send <- m:
+		return true
+	case <-c.done:
+		return false
 	}
 }
 
 // Sends periodic pings to the car.
 func (c *Client) pinger() {
+	defer c.wg.Done()
 	pingSeq := byte(0xa)
 	ticker := time.NewTicker(200 * time.Millisecond)
 	defer ticker.Stop()
-	for t := range ticker.C {
-		switch {
-		case c.closed:
+	for {
+		var t time.Time
+		select {
+		case <-c.done:
 			return
-		case t.Sub(c.lastRx) < 500*time.Millisecond:
+		case t = <-ticker.C:
+		}
+		if t.Sub(time.Unix(0, atomic.LoadInt64(&c.lastRx))) < 500*time.Millisecond {
 			continue
 		}
-		c.Send <- protocol.NewPingRequestMessage(pingSeq)
+		if !c.send(protocol.NewPingRequestMessage(pingSeq)) {
+			return
+		}
 		pingSeq++
 		if pingSeq > 0x63 {
 			pingSeq = 0
@@ -300,116 +497,138 @@ func (c *Client) pinger() {
 
 // manages the connection, handling control messages.
 func (c *Client) manage() {
-	ml := c.AddListener()
-	defer ml.Stop()
-	for m := range ml.C {
+	defer c.wg.Done()
+	ml := c.Subscribe(
+		NameOption("manage"),
+		TypeFilterOption(protocol.CmdInResp, protocol.CmdInStartResp,
+			protocol.CmdInMy24StartReq, protocol.CmdInMy18StartReq, protocol.CmdInMy14StartReq),
+		BufferSizeOption(32),
+	)
+	defer c.RemoveListener(ml)
+	start := func(year ModelYear, resp byte, m *protocol.PhevMessage) {
+		c.mu.Lock()
+		c.modelYear = year
+		c.mu.Unlock()
+		c.send(&protocol.PhevMessage{
+			Type:     resp,
+			Register: 0x1,
+			Ack:      protocol.Ack,
+			Xor:      m.Xor,
+			Data:     []byte{0x0},
+		})
+		c.startOnce.Do(func() { close(c.started) })
+	}
+	for {
+		var m *protocol.PhevMessage
+		select {
+		case <-c.done:
+			log.Debug("%PHEV_MANAGER_END%%")
+			return
+		case msg, ok := <-ml.C:
+			if !ok {
+				log.Debug("%PHEV_MANAGER_END%%")
+				return
+			}
+			m = msg
+		}
 		switch m.Type {
 		case protocol.CmdInResp:
 			if m.Ack == protocol.Request && m.Register == protocol.SettingsRegister {
 				c.Settings.FromRegister(m.Data)
 			}
+			if r, ok := m.Reg.(*protocol.RegisterTime); ok && m.Ack == protocol.Request && !r.Time.IsZero() {
+				c.checkTime(r)
+			}
 		case protocol.CmdInStartResp:
-			c.Send <- protocol.NewPingRequestMessage(0xa)
+			c.send(protocol.NewPingRequestMessage(0xa))
 		case protocol.CmdInMy24StartReq:
-			c.ModelYear = ModelYear24
-			c.Send <- &protocol.PhevMessage{
-				Type:     protocol.CmdOutMy24StartResp,
-				Register: 0x1,
-				Ack:      protocol.Ack,
-				Xor:      m.Xor,
-				Data:     []byte{0x0},
-			}
 			log.Debug("%%PHEV_START24_RECV%%")
-			c.started <- struct{}{}
+			start(ModelYear24, protocol.CmdOutMy24StartResp, m)
 		case protocol.CmdInMy18StartReq:
-			c.ModelYear = ModelYear18
-			c.Send <- &protocol.PhevMessage{
-				Type:     protocol.CmdOutMy18StartResp,
-				Register: 0x1,
-				Ack:      protocol.Ack,
-				Xor:      m.Xor,
-				Data:     []byte{0x0},
-			}
 			log.Debug("%%PHEV_START18_RECV%%")
-			c.started <- struct{}{}
+			start(ModelYear18, protocol.CmdOutMy18StartResp, m)
 		case protocol.CmdInMy14StartReq:
-			c.ModelYear = ModelYear14
-			c.Send <- &protocol.PhevMessage{
-				Type:     protocol.CmdOutMy14StartResp,
-				Register: 0x1,
-				Ack:      protocol.Ack,
-				Xor:      m.Xor,
-				Data:     []byte{0x0},
-			}
 			log.Debug("%%PHEV_START14_RECV%%")
-			c.started <- struct{}{}
+			start(ModelYear14, protocol.CmdOutMy14StartResp, m)
 		}
 	}
-	close(c.started)
-	log.Debug("%PHEV_MANAGER_END%%")
 }
 
+// reader decodes messages from the car until the connection fails or
+// the client closes, then closes Recv and the listener channels.
 func (c *Client) reader() {
+	defer c.wg.Done()
+	defer c.closeListeners()
+	defer c.shutdown()
 	log.Infof("[TCP Reader] Starting reader goroutine with read timeout: %v", c.tcpReadTimeout)
 	for {
 		log.Tracef("[TCP Reader] Setting read deadline to %v from now", c.tcpReadTimeout)
-		c.conn.(*net.TCPConn).SetReadDeadline(time.Now().Add(c.tcpReadTimeout))
-		data := make([]byte, 4096)
-		n, err := c.conn.Read(data)
+		c.conn.SetReadDeadline(time.Now().Add(c.tcpReadTimeout))
+		m, err := c.decoder.Decode()
 		if err != nil {
-			if !c.closed {
+			if !c.closing() {
 				log.Infof("[TCP Reader] Read error (timeout=%v): %v", c.tcpReadTimeout, err)
 				log.Debug("%%PHEV_TCP_READER_ERROR%%: ", err)
 			}
 			log.Info("[TCP Reader] Closing reader due to error")
 			log.Debug("%PHEV_TCP_READER_CLOSE%")
-			c.Close()
-			close(c.Recv)
-			c.lMu.Lock()
-			for _, l := range c.listeners {
-				l.Stop()
-			}
-			c.lMu.Unlock()
 			return
 		}
-		c.lastRx = time.Now()
-		log.Tracef("%%PHEV_TCP_RECV_DATA%%: %s", hex.EncodeToString(data[:n]))
-		messages := protocol.NewFromBytes(data[:n], c.key)
-		for _, m := range messages {
+		atomic.StoreInt64(&c.lastRx, time.Now().UnixNano())
+		if log.IsLevelEnabled(log.TraceLevel) {
+			log.Tracef("%%PHEV_TCP_RECV_DATA%%: %s", hex.EncodeToString(m.OriginalXored))
+		}
+		if log.IsLevelEnabled(log.DebugLevel) {
 			log.Debugf("%%PHEV_TCP_RECV_MSG%%: [%02x] %s", m.Xor, m.ShortForm())
-			c.lMu.Lock()
-			for _, l := range c.listeners {
-				l.Send(m)
-			}
-			c.lMu.Unlock()
-			c.Recv <- m
+		}
+		c.State.Update(m)
+		// Send outside the lock, as blocking listeners may wait.
+		c.lMu.Lock()
+		listeners := c.listeners
+		c.lMu.Unlock()
+		for _, l := range listeners {
+			l.Send(m)
+		}
+		select {
+		case c.Recv <- m:
+		case <-c.done:
+			return
 		}
 	}
 }
 
 func (c *Client) writer() {
+	defer c.wg.Done()
+	// Messages are encoded into the same buffer each time.
+	var data []byte
 	for {
 		select {
+		case <-c.done:
+			return
 		case msg, ok := <-c.Send:
 			if !ok {
 				log.Debug("%PHEV_TCP_WRITER_CLOSE%")
-				c.Close()
+				c.shutdown()
 				return
 			}
 			msg.Xor = 0
-			data := msg.EncodeToBytes(c.key)
-			log.Debugf("%%PHEV_TCP_SEND_MSG%%: [%02x] %s", msg.Xor, msg.ShortForm())
-			log.Tracef("%%PHEV_TCP_SEND_DATA%%: %s", hex.EncodeToString(data))
-			log.Tracef("[TCP Writer] Setting write deadline to %v from now", c.tcpWriteTimeout)
-			c.conn.(*net.TCPConn).SetWriteDeadline(time.Now().Add(c.tcpWriteTimeout))
+			data = msg.AppendEncoded(data[:0], c.key)
+			if log.IsLevelEnabled(log.DebugLevel) {
+				log.Debugf("%%PHEV_TCP_SEND_MSG%%: [%02x] %s", msg.Xor, msg.ShortForm())
+			}
+			if log.IsLevelEnabled(log.TraceLevel) {
+				log.Tracef("%%PHEV_TCP_SEND_DATA%%: %s", hex.EncodeToString(data))
+				log.Tracef("[TCP Writer] Setting write deadline to %v from now", c.tcpWriteTimeout)
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(c.tcpWriteTimeout))
 			if _, err := c.conn.Write(data); err != nil {
-				if !c.closed {
+				if !c.closing() {
 					log.Infof("[TCP Writer] Write error (timeout=%v): %v", c.tcpWriteTimeout, err)
 					log.Errorf("%%PHEV_TCP_WRITER_ERROR%%: %v", err)
 				}
 				log.Info("[TCP Writer] Closing writer due to error")
 				log.Debug("%PHEV_TCP_WRITER_CLOSE%")
-				c.Close()
+				c.shutdown()
 				return
 			}
 		}
@@ -0,0 +1,393 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/emulator"
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// freeAddress returns a local address with a free port for an emulator.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// beginCar starts car on a free local port, returning its address.
+func beginCar(t *testing.T, car *emulator.Car) string {
+	t.Helper()
+	address := freeAddress(t)
+	emulator.AddressOption(address)(car)
+	if err := car.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	return address
+}
+
+// connectCar returns a client connected to car over a net.Pipe. Like
+// the app, it acks each register the car sends, so that the car goes
+// on to send the next. The client is closed when the test ends.
+func connectCar(t *testing.T, car *emulator.Car, opts ...client.Option) *client.Client {
+	t.Helper()
+	carConn, conn := net.Pipe()
+	emulator.NewConnection(carConn, car).Start()
+	cl, err := client.New(append([]client.Option{client.ConnOption(conn)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		cl.Close()
+	})
+	go func() {
+		for m := range cl.Recv {
+			if m.Type != protocol.CmdInResp || m.Ack != protocol.Request {
+				continue
+			}
+			select {
+			case cl.Send <- &protocol.PhevMessage{
+				Type:     protocol.CmdOutSend,
+				Register: m.Register,
+				Ack:      protocol.Ack,
+				Xor:      m.Xor,
+				Data:     []byte{0x0},
+			}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return cl
+}
+
+// startCar returns a client started against car, as connectCar.
+func startCar(t *testing.T, car *emulator.Car, opts ...client.Option) *client.Client {
+	t.Helper()
+	cl := connectCar(t, car, opts...)
+	if err := cl.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cl
+}
+
+// startClient starts an emulated car and returns a client started
+// against it. Recv is drained until the client closes.
+func startClient(t *testing.T) *client.Client {
+	t.Helper()
+	car, err := emulator.NewCar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := beginCar(t, car)
+	cl, err := client.New(client.AddressOption(address), client.RegisterTimeoutOption(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range cl.Recv {
+		}
+	}()
+	if err := cl.Start(); err != nil {
+		cl.Close()
+		t.Fatal(err)
+	}
+	return cl
+}
+
+// closed reports whether ch is closed within a second.
+func closed(ch <-chan *protocol.PhevMessage) bool {
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return true
+			}
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func TestClientLifecycle(t *testing.T) {
+	cl := startClient(t)
+	if got, want := cl.ModelYear(), client.ModelYear18; got != want {
+		t.Errorf("ModelYear() = %v, want %v", got, want)
+	}
+	l := cl.Subscribe(client.AckFilterOption(protocol.Ack), client.RegisterFilterOption(0x0a))
+	if err := cl.SetRegister(0x0a, []byte{0x1}); err != nil {
+		t.Fatalf("SetRegister() = %v", err)
+	}
+	if err := cl.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if !closed(l.C) {
+		t.Errorf("listener not closed after Close()")
+	}
+	if !closed(cl.Recv) {
+		t.Errorf("Recv not closed after Close()")
+	}
+	if err := cl.Close(); err != nil {
+		t.Errorf("second Close() = %v", err)
+	}
+	if err := cl.SetRegister(0x0a, []byte{0x1}); !errors.Is(err, client.ErrClosed) {
+		t.Errorf("SetRegister() after Close() = %v, want %v", err, client.ErrClosed)
+	}
+	if err := cl.Connect(); !errors.Is(err, client.ErrClosed) {
+		t.Errorf("Connect() after Close() = %v, want %v", err, client.ErrClosed)
+	}
+	if l := cl.Subscribe(); !closed(l.C) {
+		t.Errorf("listener added after Close() not closed")
+	}
+}
+
+func TestClientCloseBeforeConnect(t *testing.T) {
+	cl, err := client.New(client.AddressOption(freeAddress(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.SetRegister(0x0a, []byte{0x1}); err == nil {
+		t.Errorf("SetRegister() before Connect() succeeded")
+	}
+	if err := cl.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if !closed(cl.Recv) {
+		t.Errorf("Recv not closed after Close()")
+	}
+	if err := cl.Connect(); !errors.Is(err, client.ErrClosed) {
+		t.Errorf("Connect() after Close() = %v, want %v", err, client.ErrClosed)
+	}
+}
+
+func TestClientConcurrentSetRegisterAndClose(t *testing.T) {
+	cl := startClient(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := cl.SetRegister(0x0a, []byte{byte(i)}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	var cwg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		cwg.Add(1)
+		go func() {
+			defer cwg.Done()
+			cl.Close()
+			cl.ModelYear()
+			cl.Health()
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		cwg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("SetRegister or Close did not return after Close")
+	}
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, client.ErrClosed) {
+			t.Errorf("SetRegister() = %v, want nil or %v", err, client.ErrClosed)
+		}
+	}
+}
+
+func TestClientTimeSync(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var writes [][]byte
+	car, err := emulator.NewCar(emulator.WriteHandlerOption(func(m *protocol.PhevMessage) emulator.WriteResponse {
+		if m.Register == protocol.SetTimeRegister {
+			mu.Lock()
+			writes = append(writes, m.Data)
+			mu.Unlock()
+		}
+		return emulator.WriteAck
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The car clock is two hours fast, and reported twice.
+	skewed := &protocol.RegisterTime{Time: time.Now().Add(2 * time.Hour)}
+	for i, r := range car.Registers {
+		if r.Register() == protocol.TimeRegister {
+			car.Registers[i] = skewed
+		}
+	}
+	car.Registers = append(car.Registers, skewed)
+
+	cl := connectCar(t, car, client.TimeSyncOption(time.Minute))
+	times := cl.Subscribe(client.TypeFilterOption(protocol.CmdInResp),
+		client.RegisterFilterOption(protocol.TimeRegister), client.AckFilterOption(protocol.Request))
+	acks := cl.Subscribe(client.TypeFilterOption(protocol.CmdInResp),
+		client.RegisterFilterOption(protocol.SetTimeRegister), client.AckFilterOption(protocol.Ack))
+	if err := cl.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-acks.C:
+	case <-time.After(10 * time.Second):
+		t.Fatal("time sync write not acked")
+	}
+	drift, ok := cl.TimeDrift()
+	if !ok {
+		t.Fatal("TimeDrift() not seen")
+	}
+	// The emulated clock stands still during the handshake.
+	if drift < 2*time.Hour-30*time.Second || drift > 2*time.Hour {
+		t.Errorf("TimeDrift() = %v, want about 2h", drift)
+	}
+	// Wait for the second report, which must not sync again.
+	for seen := 0; seen < 2; {
+		select {
+		case <-times.C:
+			seen++
+		case <-time.After(10 * time.Second):
+			t.Fatalf("saw %d time reports, want 2", seen)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(writes) != 1 {
+		t.Fatalf("time set %d times, want once", len(writes))
+	}
+	got := &protocol.RegisterTime{}
+	got.Decode(&protocol.PhevMessage{Register: protocol.TimeRegister, Data: writes[0][:7]})
+	if d := time.Since(got.Time); d < -5*time.Second || d > 5*time.Second {
+		t.Errorf("time set to %v, want about now", got.Time)
+	}
+}
+
+func TestClientStartContextCancel(t *testing.T) {
+	t.Parallel()
+	car, err := emulator.NewCar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := connectCar(t, car)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	begin := time.Now()
+	if err := cl.StartContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("StartContext() = %v, want %v", err, context.Canceled)
+	}
+	// The handshake with the emulator takes several seconds.
+	if d := time.Since(begin); d > time.Second {
+		t.Errorf("StartContext() took %v after cancel", d)
+	}
+}
+
+func TestClientSetRegisterContextDeadline(t *testing.T) {
+	t.Parallel()
+	car, err := emulator.NewCar(emulator.WriteHandlerOption(func(m *protocol.PhevMessage) emulator.WriteResponse {
+		return emulator.WriteIgnore
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := startCar(t, car, client.RegisterTimeoutOption(time.Minute))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if err := cl.SetRegisterContext(ctx, 0x0a, []byte{0x1}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SetRegisterContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(begin); d > time.Second {
+		t.Errorf("SetRegisterContext() took %v, want about 200ms", d)
+	}
+}
+
+func TestClientConnectContextCancel(t *testing.T) {
+	cl, err := client.New(client.AddressOption(freeAddress(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cl.ConnectContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("ConnectContext() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestClientConnOption(t *testing.T) {
+	car, err := emulator.NewCar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	carConn, conn := net.Pipe()
+	emulator.NewConnection(carConn, car).Start()
+	cl, err := client.New(client.ConnOption(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if err := cl.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range cl.Recv {
+		}
+	}()
+	if err := cl.Start(); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	if err := cl.SetRegister(0x0a, []byte{0x1}); err != nil {
+		t.Errorf("SetRegister() = %v", err)
+	}
+}
+
+func TestClientDialerOption(t *testing.T) {
+	want := errors.New("no route to car")
+	var gotAddress string
+	cl, err := client.New(
+		client.AddressOption("car:8080"),
+		client.DialerOption(func(ctx context.Context, network, address string) (net.Conn, error) {
+			gotAddress = address
+			return nil, want
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Connect(); err != want {
+		t.Errorf("Connect() = %v, want %v", err, want)
+	}
+	if gotAddress != "car:8080" {
+		t.Errorf("dialled %q, want %q", gotAddress, "car:8080")
+	}
+}
@@ -0,0 +1,245 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// errNotConnected is returned for commands sent before Connect.
+var errNotConnected = errors.New("not connected")
+
+// A CommandResult reports how a register write went.
+type CommandResult struct {
+	Register byte
+	Data     []byte
+	// Queued is when the command was queued, Sent when it was first
+	// sent to the car, and Done when it was acknowledged or failed.
+	// Sent is zero if the command was never sent.
+	Queued, Sent, Done time.Time
+	// Retries counts resends after bad encoding replies from the car.
+	Retries int
+	// Err is nil once the car has acknowledged the write.
+	Err error
+}
+
+// Wait returns how long the command waited in the queue.
+func (r *CommandResult) Wait() time.Duration {
+	if r.Sent.IsZero() {
+		return r.Done.Sub(r.Queued)
+	}
+	return r.Sent.Sub(r.Queued)
+}
+
+// Latency returns how long the car took to acknowledge the command,
+// including retries.
+func (r *CommandResult) Latency() time.Duration {
+	if r.Sent.IsZero() {
+		return 0
+	}
+	return r.Done.Sub(r.Sent)
+}
+
+func (r *CommandResult) String() string {
+	s := fmt.Sprintf("register 0x%02x: waited %v, took %v, %d retries",
+		r.Register, r.Wait().Round(time.Millisecond), r.Latency().Round(time.Millisecond), r.Retries)
+	if r.Err != nil {
+		s += fmt.Sprintf(": %v", r.Err)
+	}
+	return s
+}
+
+// A command is a register write queued for the commander.
+type command struct {
+	ctx    context.Context
+	result CommandResult
+	// done is closed once result is complete.
+	done chan struct{}
+}
+
+// SetRegisterResult sets a register on the car as SetRegisterContext,
+// returning how the write went. Writes are queued and sent to the car
+// one at a time, so that each ack or bad encoding reply belongs to the
+// write in flight. The register timeout applies from when the write is
+// first sent, ctx to the whole call.
+func (c *Client) SetRegisterResult(ctx context.Context, register byte, value []byte) *CommandResult {
+	cmd := &command{
+		ctx: ctx,
+		result: CommandResult{
+			Register: register,
+			Data:     value,
+			Queued:   time.Now(),
+		},
+		done: make(chan struct{}),
+	}
+	fail := func(err error) *CommandResult {
+		cmd.result.Err = err
+		cmd.result.Done = time.Now()
+		return &cmd.result
+	}
+	if !c.connectedNow() && !c.closing() {
+		return fail(errNotConnected)
+	}
+	select {
+	case c.commands <- cmd:
+	case <-ctx.Done():
+		return fail(ctx.Err())
+	case <-c.done:
+		return fail(ErrClosed)
+	}
+	// The commander gives up on ctx or close, so this does not block
+	// for long.
+	<-cmd.done
+	return &cmd.result
+}
+
+// An unacked is a count of writes to a register given up on before the
+// car acknowledged them. Their acks may yet arrive, and must not be
+// taken for the ack of a later write, until the register timeout.
+type unacked struct {
+	count int
+	until time.Time
+}
+
+// commander runs queued commands until the connection closes. Its
+// listener blocks rather than dropping acks, so it is drained while
+// idle.
+func (c *Client) commander() {
+	defer c.wg.Done()
+	l := c.Subscribe(
+		NameOption("commands"),
+		TypeFilterOption(protocol.CmdInResp, protocol.CmdInBadEncoding),
+		BufferSizeOption(16),
+		BlockingOption(),
+	)
+	defer c.RemoveListener(l)
+	pending := map[byte]*unacked{}
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg, ok := <-l.C:
+			if !ok {
+				return
+			}
+			lateAck(pending, msg)
+		case cmd := <-c.commands:
+			c.runCommand(cmd, l, pending)
+			close(cmd.done)
+			log.Debugf("%%PHEV_COMMAND%%: %s", &cmd.result)
+		}
+	}
+}
+
+// lateAck returns whether msg is the ack of a write already given up
+// on, counting it off.
+func lateAck(pending map[byte]*unacked, msg *protocol.PhevMessage) bool {
+	if msg.Type != protocol.CmdInResp || msg.Ack != protocol.Ack {
+		return false
+	}
+	p, ok := pending[msg.Register]
+	if !ok {
+		return false
+	}
+	if time.Now().After(p.until) {
+		delete(pending, msg.Register)
+		return false
+	}
+	if p.count--; p.count == 0 {
+		delete(pending, msg.Register)
+	}
+	return true
+}
+
+// runCommand sends cmd to the car and waits for the ack, resending on
+// bad encoding replies. Acks of earlier writes given up on, counted in
+// pending, are skipped.
+func (c *Client) runCommand(cmd *command, l *Listener, pending map[byte]*unacked) {
+	r := &cmd.result
+	// awaiting is whether a write has been sent with no reply yet.
+	awaiting := false
+	defer func() {
+		r.Done = time.Now()
+		if r.Err != nil && awaiting {
+			p, ok := pending[r.Register]
+			if !ok {
+				p = &unacked{}
+				pending[r.Register] = p
+			}
+			p.count++
+			p.until = r.Done.Add(c.registerTimeout)
+		}
+	}()
+	if err := cmd.ctx.Err(); err != nil {
+		r.Err = err
+		return
+	}
+	// Discard replies to earlier commands, and anything else received
+	// while idle.
+	for len(l.C) > 0 {
+		lateAck(pending, <-l.C)
+	}
+	timer := time.NewTimer(c.registerTimeout)
+	defer timer.Stop()
+	timeout := fmt.Errorf("timed out attempting to set register %02x", r.Register)
+	xor := byte(0)
+	for {
+		select {
+		case c.Send <- &protocol.PhevMessage{
+			Type:     protocol.CmdOutSend,
+			Ack:      protocol.Request,
+			Register: r.Register,
+			Data:     r.Data,
+			Xor:      xor,
+		}:
+		case <-timer.C:
+			r.Err = timeout
+			return
+		case <-cmd.ctx.Done():
+			r.Err = cmd.ctx.Err()
+			return
+		case <-c.done:
+			r.Err = ErrClosed
+			return
+		}
+		awaiting = true
+		if r.Sent.IsZero() {
+			r.Sent = time.Now()
+		}
+	wait:
+		for {
+			select {
+			case <-timer.C:
+				r.Err = timeout
+				return
+			case <-cmd.ctx.Done():
+				r.Err = cmd.ctx.Err()
+				return
+			case <-c.done:
+				r.Err = ErrClosed
+				return
+			case msg, ok := <-l.C:
+				switch {
+				case !ok:
+					r.Err = ErrClosed
+					return
+				case lateAck(pending, msg):
+				case msg.Type == protocol.CmdInBadEncoding:
+					if len(msg.Data) > 0 {
+						xor = msg.Data[0]
+					}
+					awaiting = false
+					r.Retries++
+					break wait
+				case msg.Type == protocol.CmdInResp && msg.Ack == protocol.Ack && msg.Register == r.Register:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/emulator"
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+func TestSetRegisterResult(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	badEncodings := 1
+	// ackedAt is when the car acked each write to register 0x0a, by
+	// value.
+	ackedAt := map[byte]time.Time{}
+	car, err := emulator.NewCar(emulator.WriteHandlerOption(func(m *protocol.PhevMessage) emulator.WriteResponse {
+		mu.Lock()
+		defer mu.Unlock()
+		switch m.Register {
+		case 0x0b:
+			if badEncodings > 0 {
+				badEncodings--
+				return emulator.WriteBadEncoding
+			}
+		case 0x0a:
+			switch m.Data[0] {
+			case 0x1:
+				time.Sleep(100 * time.Millisecond)
+			case 0x2:
+				time.Sleep(600 * time.Millisecond)
+			case 0x3:
+				time.Sleep(300 * time.Millisecond)
+			}
+			ackedAt[m.Data[0]] = time.Now()
+		}
+		return emulator.WriteAck
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := startCar(t, car, client.RegisterTimeoutOption(5*time.Second))
+	ctx := context.Background()
+
+	t.Run("retries", func(t *testing.T) {
+		r := cl.SetRegisterResult(ctx, 0x0b, []byte{0x1})
+		if r.Err != nil {
+			t.Fatalf("Err = %v", r.Err)
+		}
+		if r.Retries != 1 {
+			t.Errorf("Retries = %d, want 1", r.Retries)
+		}
+	})
+
+	t.Run("timing", func(t *testing.T) {
+		r := cl.SetRegisterResult(ctx, 0x0a, []byte{0x1})
+		if r.Err != nil {
+			t.Fatalf("Err = %v", r.Err)
+		}
+		if r.Sent.Before(r.Queued) || r.Done.Before(r.Sent) {
+			t.Errorf("got Queued %v, Sent %v, Done %v, want in order", r.Queued, r.Sent, r.Done)
+		}
+		if r.Latency() < 100*time.Millisecond {
+			t.Errorf("Latency() = %v, want at least the car's 100ms", r.Latency())
+		}
+		if r.Wait() > r.Latency() {
+			t.Errorf("Wait() = %v, want less than Latency() %v", r.Wait(), r.Latency())
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		results := make([]*client.CommandResult, 2)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = cl.SetRegisterResult(ctx, 0x0a, []byte{0x1})
+			}(i)
+		}
+		wg.Wait()
+		first, second := results[0], results[1]
+		if second.Sent.Before(first.Sent) {
+			first, second = second, first
+		}
+		for _, r := range results {
+			if r.Err != nil {
+				t.Fatalf("Err = %v", r.Err)
+			}
+		}
+		// Each waits the car's 100ms for its own ack, one after the
+		// other.
+		if second.Sent.Before(first.Done) {
+			t.Errorf("second sent at %v, before first done at %v", second.Sent, first.Done)
+		}
+		if first.Latency() < 100*time.Millisecond || second.Latency() < 100*time.Millisecond {
+			t.Errorf("Latency() = %v and %v, want at least 100ms each", first.Latency(), second.Latency())
+		}
+	})
+
+	t.Run("late ack", func(t *testing.T) {
+		tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		if r := cl.SetRegisterResult(tctx, 0x0a, []byte{0x2}); !errors.Is(r.Err, context.DeadlineExceeded) {
+			t.Fatalf("Err = %v, want %v", r.Err, context.DeadlineExceeded)
+		}
+		r := cl.SetRegisterResult(ctx, 0x0a, []byte{0x3})
+		if r.Err != nil {
+			t.Fatalf("Err = %v", r.Err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if acked := ackedAt[0x3]; r.Done.Before(acked) {
+			t.Errorf("done at %v, before the car acked at %v", r.Done, acked)
+		}
+	})
+}
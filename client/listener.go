@@ -0,0 +1,206 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// defaultListenerBuffer is the channel size of a Listener, unless set
+// with BufferSizeOption.
+const defaultListenerBuffer = 5
+
+// A Listener is for communicating messages from the vehicle to
+// interested clients.
+type Listener struct {
+	// C has received messages.
+	C    chan *protocol.PhevMessage
+	stop bool
+
+	// name identifies the listener in logs.
+	name      string
+	types     map[byte]bool
+	registers map[byte]bool
+	ack       *byte
+	size      int
+	block     bool
+
+	dropped  uint64
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// A ListenerOption configures a Listener.
+type ListenerOption func(l *Listener)
+
+// NameOption names the listener in logs, such as when it drops a
+// message.
+func NameOption(name string) ListenerOption {
+	return func(l *Listener) {
+		l.name = name
+	}
+}
+
+// TypeFilterOption only passes messages of the given types.
+func TypeFilterOption(types ...byte) ListenerOption {
+	return func(l *Listener) {
+		l.types = map[byte]bool{}
+		for _, t := range types {
+			l.types[t] = true
+		}
+	}
+}
+
+// RegisterFilterOption only passes messages for the given registers.
+func RegisterFilterOption(registers ...byte) ListenerOption {
+	return func(l *Listener) {
+		l.registers = map[byte]bool{}
+		for _, r := range registers {
+			l.registers[r] = true
+		}
+	}
+}
+
+// AckFilterOption only passes messages with the given ack flag, either
+// protocol.Request or protocol.Ack.
+func AckFilterOption(ack byte) ListenerOption {
+	return func(l *Listener) {
+		l.ack = &ack
+	}
+}
+
+// BufferSizeOption sets the size of the listener's channel. The
+// default is 5.
+func BufferSizeOption(size int) ListenerOption {
+	return func(l *Listener) {
+		l.size = size
+	}
+}
+
+// BlockingOption makes the listener wait for room in its channel
+// rather than drop messages when it is full. This holds up every
+// other listener, so the channel must be drained promptly until the
+// listener is removed.
+func BlockingOption() ListenerOption {
+	return func(l *Listener) {
+		l.block = true
+	}
+}
+
+// NewListener returns a started Listener.
+func NewListener(opts ...ListenerOption) *Listener {
+	l := &Listener{}
+	for _, o := range opts {
+		o(l)
+	}
+	l.Start()
+	return l
+}
+
+func (l *Listener) Start() {
+	l.stop = false
+	if l.size <= 0 {
+		l.size = defaultListenerBuffer
+	}
+	l.C = make(chan *protocol.PhevMessage, l.size)
+	l.done = make(chan struct{})
+}
+
+func (l *Listener) Stop() {
+	l.stop = true
+}
+
+// wants returns whether m passes the listener's filters.
+func (l *Listener) wants(m *protocol.PhevMessage) bool {
+	switch {
+	case l.types != nil && !l.types[m.Type]:
+		return false
+	case l.registers != nil && !l.registers[m.Register]:
+		return false
+	case l.ack != nil && *l.ack != m.Ack:
+		return false
+	}
+	return true
+}
+
+func (l *Listener) Send(m *protocol.PhevMessage) {
+	if !l.wants(m) {
+		return
+	}
+	if l.block {
+		select {
+		case l.C <- m:
+		case <-l.done:
+		}
+		return
+	}
+	select {
+	case l.C <- m:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+		log.Debugf("%%PHEV_RECV_LISTENER%% %s message not sent: %s", l.name, m.ShortForm())
+	}
+}
+
+// Dropped returns the count of messages dropped because the listener's
+// channel was full.
+func (l *Listener) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// detach releases any Send blocked on the listener, once it has been
+// removed.
+func (l *Listener) detach() {
+	l.doneOnce.Do(func() {
+		if l.done != nil {
+			close(l.done)
+		}
+	})
+}
+
+func (l *Listener) ProcessStop() bool {
+	if l.stop {
+		close(l.C)
+		l.stop = false
+		return true
+	}
+	return false
+}
+
+// Subscribe returns a new Listener configured by opts, receiving
+// messages until removed with RemoveListener. Its channel is closed if
+// the client closes first.
+func (c *Client) Subscribe(opts ...ListenerOption) *Listener {
+	l := NewListener(opts...)
+	c.lMu.Lock()
+	defer c.lMu.Unlock()
+	if c.lClosed {
+		// The client has closed, so nothing more will be received.
+		close(l.C)
+		l.detach()
+		return l
+	}
+	c.listeners = append(c.listeners, l)
+	return l
+}
+
+// Create and return a new Listener.
+func (c *Client) AddListener() *Listener {
+	return c.Subscribe()
+}
+
+func (c *Client) RemoveListener(l *Listener) {
+	newL := []*Listener{}
+	c.lMu.Lock()
+	defer c.lMu.Unlock()
+	for _, lis := range c.listeners {
+		if lis != l {
+			newL = append(newL, lis)
+		}
+	}
+	c.listeners = newL
+	l.detach()
+}
@@ -0,0 +1,127 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+func TestListenerFilters(t *testing.T) {
+	msgs := []*protocol.PhevMessage{
+		{Type: protocol.CmdInResp, Ack: protocol.Request, Register: 0x1d},
+		{Type: protocol.CmdInResp, Ack: protocol.Ack, Register: 0x1d},
+		{Type: protocol.CmdInResp, Ack: protocol.Ack, Register: 0x0a},
+		{Type: protocol.CmdInPingResp, Ack: protocol.Request, Register: 0x0a},
+		{Type: protocol.CmdInBadEncoding, Ack: protocol.Request, Register: 0x0a},
+	}
+	tests := []struct {
+		name string
+		opts []client.ListenerOption
+		want []int
+	}{
+		{"none", nil, []int{0, 1, 2, 3, 4}},
+		{"type", []client.ListenerOption{client.TypeFilterOption(protocol.CmdInResp, protocol.CmdInBadEncoding)}, []int{0, 1, 2, 4}},
+		{"register", []client.ListenerOption{client.RegisterFilterOption(0x1d)}, []int{0, 1}},
+		{"ack", []client.ListenerOption{client.AckFilterOption(protocol.Ack)}, []int{1, 2}},
+		{"all", []client.ListenerOption{
+			client.TypeFilterOption(protocol.CmdInResp),
+			client.RegisterFilterOption(0x0a),
+			client.AckFilterOption(protocol.Ack),
+		}, []int{2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := client.NewListener(append(test.opts, client.BufferSizeOption(len(msgs)))...)
+			for _, m := range msgs {
+				l.Send(m)
+			}
+			if len(l.C) != len(test.want) {
+				t.Fatalf("got %d messages, want %d", len(l.C), len(test.want))
+			}
+			for _, i := range test.want {
+				if m := <-l.C; m != msgs[i] {
+					t.Errorf("got %+v, want message %d %+v", m, i, msgs[i])
+				}
+			}
+			if l.Dropped() != 0 {
+				t.Errorf("Dropped() = %d, want 0", l.Dropped())
+			}
+		})
+	}
+}
+
+func TestListenerDropped(t *testing.T) {
+	l := client.NewListener(client.BufferSizeOption(2))
+	for i := 0; i < 5; i++ {
+		l.Send(&protocol.PhevMessage{Type: protocol.CmdInResp, Register: byte(i)})
+	}
+	if got := l.Dropped(); got != 3 {
+		t.Errorf("Dropped() = %d, want 3", got)
+	}
+	if got := len(l.C); got != 2 {
+		t.Errorf("kept %d messages, want 2", got)
+	}
+	// Filtered messages are not dropped.
+	l = client.NewListener(client.BufferSizeOption(1), client.RegisterFilterOption(0x1))
+	for i := 0; i < 5; i++ {
+		l.Send(&protocol.PhevMessage{Type: protocol.CmdInResp, Register: byte(i)})
+	}
+	if got := l.Dropped(); got != 0 {
+		t.Errorf("filtered Dropped() = %d, want 0", got)
+	}
+}
+
+func TestListenerBlocking(t *testing.T) {
+	l := client.NewListener(client.BufferSizeOption(1), client.BlockingOption())
+	const burst = 100
+	go func() {
+		for i := 0; i < burst; i++ {
+			l.Send(&protocol.PhevMessage{Type: protocol.CmdInResp, Register: byte(i)})
+		}
+	}()
+	for i := 0; i < burst; i++ {
+		select {
+		case m := <-l.C:
+			if m.Register != byte(i) {
+				t.Fatalf("got register %d, want %d", m.Register, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d of %d messages", i, burst)
+		}
+	}
+	if l.Dropped() != 0 {
+		t.Errorf("Dropped() = %d, want 0", l.Dropped())
+	}
+}
+
+func TestListenerBlockingRemoved(t *testing.T) {
+	cl, err := client.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	l := cl.Subscribe(client.BufferSizeOption(1), client.BlockingOption())
+	m := &protocol.PhevMessage{Type: protocol.CmdInResp}
+	l.Send(m)
+	sent := make(chan struct{})
+	go func() {
+		// Blocks, as the channel is full.
+		l.Send(m)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("Send() did not block on a full channel")
+	case <-time.After(100 * time.Millisecond):
+	}
+	cl.RemoveListener(l)
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send() not released by RemoveListener()")
+	}
+	// Once removed, Send does not block.
+	l.Send(m)
+}
@@ -0,0 +1,276 @@
+package client
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// A Field names a piece of vehicle state.
+type Field string
+
+const (
+	FieldVIN              Field = "vin"
+	FieldRegistrations    Field = "registrations"
+	FieldECUVersion       Field = "ecu_version"
+	FieldTime             Field = "time"
+	FieldWIFISSID         Field = "wifi_ssid"
+	FieldBatteryLevel     Field = "battery.level"
+	FieldBatteryWarning   Field = "battery.warning"
+	FieldChargePlugged    Field = "charge.plugged"
+	FieldCharging         Field = "charge.charging"
+	FieldChargeRemaining  Field = "charge.remaining"
+	FieldDoorsLocked      Field = "door.locked"
+	FieldDoorDriver       Field = "door.driver"
+	FieldDoorPassenger    Field = "door.front_passenger"
+	FieldDoorRearLeft     Field = "door.rear_left"
+	FieldDoorRearRight    Field = "door.rear_right"
+	FieldBonnet           Field = "door.bonnet"
+	FieldBoot             Field = "door.boot"
+	FieldHeadlights       Field = "lights.head"
+	FieldParkingLights    Field = "lights.parking"
+	FieldInteriorLights   Field = "lights.interior"
+	FieldHazardLights     Field = "lights.hazard"
+	FieldClimateMode      Field = "climate.mode"
+	FieldClimateState     Field = "climate.state"
+	FieldClimateOperating Field = "climate.operating"
+	FieldIgnition         Field = "ignition"
+)
+
+// RegisterField is the field holding the raw data of a register, hex
+// encoded, which changes whenever any of its bits do.
+func RegisterField(register byte) Field {
+	return Field(fmt.Sprintf("register.%02x", register))
+}
+
+// DefinedField is the field holding a field of a register loaded from
+// a definition file.
+func DefinedField(d *protocol.RegisterDefinition, field string) Field {
+	return Field(d.Name + "." + field)
+}
+
+// A FieldValue is the current value of a field.
+type FieldValue struct {
+	Value interface{}
+	// Updated is when the car last reported the field, and Changed
+	// when it last reported a different value.
+	Updated, Changed time.Time
+}
+
+// A Change is a field changing value. Old is nil when the field is
+// first reported.
+type Change struct {
+	Field    Field
+	Old, New interface{}
+	// Time is when the change was received, and Since when the old
+	// value was first received.
+	Time, Since time.Time
+}
+
+func (c Change) String() string {
+	if c.Old == nil {
+		return fmt.Sprintf("%s: %v", c.Field, c.New)
+	}
+	return fmt.Sprintf("%s: %v -> %v", c.Field, c.Old, c.New)
+}
+
+// stateBufferSize is the changes buffered for each subscription.
+const stateBufferSize = 64
+
+// A StateSubscription receives changes to the fields it subscribed to.
+type StateSubscription struct {
+	// C receives the changes. It is closed by State.Unsubscribe.
+	C      <-chan Change
+	c      chan Change
+	fields map[Field]bool
+}
+
+func (sub *StateSubscription) wants(f Field) bool {
+	return len(sub.fields) == 0 || sub.fields[f]
+}
+
+// A State is the vehicle state, built from the registers received from
+// the car. It is safe for concurrent use.
+type State struct {
+	mu      sync.Mutex
+	vehicle protocol.VehicleState
+	fields  map[Field]FieldValue
+	subs    []*StateSubscription
+}
+
+// NewState returns an empty State.
+func NewState() *State {
+	return &State{fields: map[Field]FieldValue{}}
+}
+
+// Update folds in the register carried by a message, if any, notifying
+// subscribers of the fields which changed. It returns the changes.
+func (s *State) Update(m *protocol.PhevMessage) []Change {
+	if m.Type != protocol.CmdInResp || m.Ack != protocol.Request {
+		return nil
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vehicle.UpdateFromMessage(m)
+	var changes []Change
+	set := func(f Field, v interface{}) {
+		old, ok := s.fields[f]
+		if ok && old.Value == v {
+			old.Updated = now
+			s.fields[f] = old
+			return
+		}
+		s.fields[f] = FieldValue{Value: v, Updated: now, Changed: now}
+		c := Change{Field: f, New: v, Time: now}
+		if ok {
+			c.Old, c.Since = old.Value, old.Changed
+		}
+		changes = append(changes, c)
+	}
+	set(RegisterField(m.Register), hex.EncodeToString(m.Data))
+	if m.Reg != nil && m.Reg.Raw() != "" {
+		registerFields(m.Reg, set)
+	}
+	for _, c := range changes {
+		for _, sub := range s.subs {
+			if !sub.wants(c.Field) {
+				continue
+			}
+			select {
+			case sub.c <- c:
+			default:
+				log.Debugf("%%PHEV_STATE%% change to %s not sent", c.Field)
+			}
+		}
+	}
+	return changes
+}
+
+// registerFields sets the fields decoded from a register. Readings the
+// car is known to send while asleep, such as a zero battery level, are
+// skipped so that the last good reading stands.
+func registerFields(r protocol.Register, set func(Field, interface{})) {
+	switch reg := r.(type) {
+	case *protocol.RegisterVIN:
+		set(FieldVIN, reg.VIN)
+		set(FieldRegistrations, reg.Registrations)
+	case *protocol.RegisterECUVersion:
+		set(FieldECUVersion, reg.Version)
+	case *protocol.RegisterTime:
+		set(FieldTime, reg.Time)
+	case *protocol.RegisterWIFISSID:
+		set(FieldWIFISSID, reg.SSID)
+	case *protocol.RegisterBatteryLevel:
+		if reg.Level > 5 && reg.Level < 255 {
+			set(FieldBatteryLevel, reg.Level)
+		}
+		set(FieldParkingLights, reg.ParkingLights)
+	case *protocol.RegisterBatteryWarning:
+		set(FieldBatteryWarning, reg.Warning)
+	case *protocol.RegisterChargePlug:
+		set(FieldChargePlugged, reg.Connected)
+	case *protocol.RegisterChargeStatus:
+		set(FieldCharging, reg.Charging)
+		if reg.Remaining < 1000 {
+			set(FieldChargeRemaining, reg.Remaining)
+		}
+	case *protocol.RegisterDoorStatus:
+		set(FieldDoorsLocked, reg.Locked)
+		set(FieldDoorDriver, reg.Driver)
+		set(FieldDoorPassenger, reg.FrontPassenger)
+		set(FieldDoorRearLeft, reg.RearLeft)
+		set(FieldDoorRearRight, reg.RearRight)
+		set(FieldBonnet, reg.Bonnet)
+		set(FieldBoot, reg.Boot)
+		set(FieldHeadlights, reg.Headlights)
+	case *protocol.RegisterLightStatus:
+		set(FieldInteriorLights, reg.Interior)
+		set(FieldHazardLights, reg.Hazard)
+	case *protocol.RegisterACMode:
+		set(FieldClimateMode, reg.Mode)
+	case *protocol.RegisterPreACState:
+		set(FieldClimateState, reg.State)
+	case *protocol.RegisterACOperStatus:
+		set(FieldClimateOperating, reg.Operating)
+		set(FieldIgnition, reg.Ignition)
+	case *protocol.RegisterDefined:
+		for _, f := range reg.Fields {
+			set(DefinedField(reg.Definition, f.Name), f.String())
+		}
+	}
+}
+
+// Get returns the value of a field, and false if the car has not
+// reported it.
+func (s *State) Get(f Field) (FieldValue, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.fields[f]
+	return v, ok
+}
+
+// Fields returns the value of every field reported.
+func (s *State) Fields() map[Field]FieldValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fields := make(map[Field]FieldValue, len(s.fields))
+	for f, v := range s.fields {
+		fields[f] = v
+	}
+	return fields
+}
+
+// Vehicle returns a snapshot of the decoded registers.
+func (s *State) Vehicle() protocol.VehicleState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := s.vehicle
+	v.Settings = append([]protocol.Setting(nil), v.Settings...)
+	if v.Other != nil {
+		v.Other = make(map[string]*protocol.RegisterGeneric, len(s.vehicle.Other))
+		for k, r := range s.vehicle.Other {
+			v.Other[k] = r
+		}
+	}
+	if v.Defined != nil {
+		v.Defined = make(map[string]*protocol.RegisterDefined, len(s.vehicle.Defined))
+		for k, r := range s.vehicle.Defined {
+			v.Defined[k] = r
+		}
+	}
+	return v
+}
+
+// Subscribe returns a subscription to changes of the given fields, or
+// of all fields if none are given. Changes are dropped if the
+// subscription's buffer is full, so C should be drained promptly.
+func (s *State) Subscribe(fields ...Field) *StateSubscription {
+	c := make(chan Change, stateBufferSize)
+	sub := &StateSubscription{C: c, c: c, fields: map[Field]bool{}}
+	for _, f := range fields {
+		sub.fields[f] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs = append(s.subs, sub)
+	return sub
+}
+
+// Unsubscribe stops a subscription and closes its channel.
+func (s *State) Unsubscribe(sub *StateSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range s.subs {
+		if v == sub {
+			s.subs = append(s.subs[:i], s.subs[i+1:]...)
+			close(sub.c)
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package client_test
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// registerMessage returns a register update from the car, decoded as
+// the reader does.
+func registerMessage(t *testing.T, register byte, data string) *protocol.PhevMessage {
+	t.Helper()
+	d, err := hex.DecodeString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &protocol.PhevMessage{Type: protocol.CmdInResp, Ack: protocol.Request, Register: register, Data: d}
+	m.Reg = protocol.NewRegister(register, client.ModelYear18)
+	m.Reg.Decode(m)
+	return m
+}
+
+// fieldChange returns the change to f among changes.
+func fieldChange(changes []client.Change, f client.Field) (client.Change, bool) {
+	for _, c := range changes {
+		if c.Field == f {
+			return c, true
+		}
+	}
+	return client.Change{}, false
+}
+
+func TestStateUpdate(t *testing.T) {
+	s := client.NewState()
+	changes := s.Update(registerMessage(t, protocol.BatteryLevelRegister, "50000000"))
+	c, ok := fieldChange(changes, client.FieldBatteryLevel)
+	if !ok || c.Old != nil || c.New != 80 || !c.Since.IsZero() {
+		t.Errorf("first change = %+v, want level 80 with no old value", c)
+	}
+	first, _ := s.Get(client.FieldBatteryLevel)
+
+	time.Sleep(10 * time.Millisecond)
+	changes = s.Update(registerMessage(t, protocol.BatteryLevelRegister, "50000000"))
+	if c, ok := fieldChange(changes, client.FieldBatteryLevel); ok {
+		t.Errorf("unchanged level reported as %v", c)
+	}
+	again, _ := s.Get(client.FieldBatteryLevel)
+	if !again.Updated.After(first.Updated) || !again.Changed.Equal(first.Changed) {
+		t.Errorf("unchanged level got %+v after %+v, want only Updated later", again, first)
+	}
+
+	changes = s.Update(registerMessage(t, protocol.BatteryLevelRegister, "51000000"))
+	c, ok = fieldChange(changes, client.FieldBatteryLevel)
+	if !ok || c.Old != 80 || c.New != 81 || !c.Since.Equal(first.Changed) || !c.Time.After(c.Since) {
+		t.Errorf("change = %+v, want 80 -> 81 since %v", c, first.Changed)
+	}
+	if c, ok := fieldChange(changes, client.RegisterField(protocol.BatteryLevelRegister)); !ok || c.Old != "50000000" || c.New != "51000000" {
+		t.Errorf("register change = %+v, want 50000000 -> 51000000", c)
+	}
+
+	// Acks and writes are not state.
+	ack := registerMessage(t, protocol.BatteryLevelRegister, "10000000")
+	ack.Ack = protocol.Ack
+	if changes := s.Update(ack); changes != nil {
+		t.Errorf("ack changed %v", changes)
+	}
+}
+
+func TestStateSleepReadings(t *testing.T) {
+	s := client.NewState()
+	s.Update(registerMessage(t, protocol.BatteryLevelRegister, "50000000"))
+	s.Update(registerMessage(t, protocol.ChargeStatusRegister, "011e00"))
+	for _, m := range []*protocol.PhevMessage{
+		registerMessage(t, protocol.BatteryLevelRegister, "05000000"),
+		registerMessage(t, protocol.BatteryLevelRegister, "00000000"),
+		registerMessage(t, protocol.BatteryLevelRegister, "ff000000"),
+		registerMessage(t, protocol.ChargeStatusRegister, "01e803"),
+	} {
+		s.Update(m)
+	}
+	if v, _ := s.Get(client.FieldBatteryLevel); v.Value != 80 {
+		t.Errorf("battery level = %v, want 80", v.Value)
+	}
+	if v, _ := s.Get(client.FieldChargeRemaining); v.Value != 30 {
+		t.Errorf("charge remaining = %v, want 30", v.Value)
+	}
+	s.Update(registerMessage(t, protocol.BatteryLevelRegister, "06000000"))
+	if v, _ := s.Get(client.FieldBatteryLevel); v.Value != 6 {
+		t.Errorf("battery level = %v, want 6", v.Value)
+	}
+}
+
+func TestStateSubscribe(t *testing.T) {
+	s := client.NewState()
+	level := s.Subscribe(client.FieldBatteryLevel)
+	all := s.Subscribe()
+	s.Update(registerMessage(t, protocol.BatteryLevelRegister, "50000100"))
+	s.Update(registerMessage(t, protocol.ChargeStatusRegister, "011e00"))
+
+	if got := len(level.C); got != 1 {
+		t.Fatalf("level subscription got %d changes, want 1", got)
+	}
+	if c := <-level.C; c.Field != client.FieldBatteryLevel || c.New != 80 {
+		t.Errorf("level subscription got %v", c)
+	}
+	fields := map[client.Field]bool{}
+	for len(all.C) > 0 {
+		fields[(<-all.C).Field] = true
+	}
+	for _, f := range []client.Field{
+		client.FieldBatteryLevel,
+		client.FieldParkingLights,
+		client.FieldCharging,
+		client.FieldChargeRemaining,
+		client.RegisterField(protocol.BatteryLevelRegister),
+	} {
+		if !fields[f] {
+			t.Errorf("subscription to all fields missed %s", f)
+		}
+	}
+
+	s.Unsubscribe(level)
+	if _, ok := <-level.C; ok {
+		t.Errorf("C not closed by Unsubscribe")
+	}
+	s.Update(registerMessage(t, protocol.BatteryLevelRegister, "51000100"))
+	if got := len(all.C); got == 0 {
+		t.Errorf("remaining subscription got no changes")
+	}
+}
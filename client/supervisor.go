@@ -0,0 +1,368 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// A BadEncodingError is the reason a supervised connection was closed
+// after too many bad encoding messages from the car.
+type BadEncodingError struct {
+	Count  int
+	Window time.Duration
+}
+
+func (e *BadEncodingError) Error() string {
+	return fmt.Sprintf("disconnected after %d bad encoding messages within %v of each other", e.Count, e.Window)
+}
+
+// A ConnState is a stage in the lifecycle of a supervised connection.
+type ConnState int
+
+const (
+	// ConnConnecting is dialling the car.
+	ConnConnecting ConnState = iota
+	// ConnHandshaking is waiting for the start handshake.
+	ConnHandshaking
+	// ConnUp is connected and started.
+	ConnUp
+	// ConnDown is disconnected, or failed to connect.
+	ConnDown
+)
+
+var connStateStr = map[ConnState]string{
+	ConnConnecting:  "connecting",
+	ConnHandshaking: "handshaking",
+	ConnUp:          "up",
+	ConnDown:        "down",
+}
+
+func (s ConnState) String() string {
+	if str, ok := connStateStr[s]; ok {
+		return str
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// A ConnEvent reports a change in state of a supervised connection.
+type ConnEvent struct {
+	State ConnState
+	Time  time.Time
+	// Attempt counts the attempts to connect since the connection last
+	// stayed up, from 1.
+	Attempt int
+	// Err is the reason for ConnDown, or nil if the session ended
+	// normally.
+	Err error
+	// Retry is how long until the next attempt after ConnDown, or zero
+	// if there will be none.
+	Retry time.Duration
+}
+
+func (e ConnEvent) String() string {
+	s := fmt.Sprintf("%s (attempt %d)", e.State, e.Attempt)
+	if e.Err != nil {
+		s += fmt.Sprintf(": %v", e.Err)
+	}
+	if e.Retry > 0 {
+		s += fmt.Sprintf(", retrying in %v", e.Retry.Round(time.Millisecond))
+	}
+	return s
+}
+
+// A Supervisor connects to the car and keeps the connection up,
+// retrying with exponential backoff and jitter when it fails. It also
+// drops connections on which the car reports too many bad encodings,
+// as these do not recover.
+type Supervisor struct {
+	newClient         func() (*Client, error)
+	minBackoff        time.Duration
+	maxBackoff        time.Duration
+	jitter            float64
+	maxAttempts       int
+	badEncodingLimit  int
+	badEncodingWindow time.Duration
+	onEvent           func(ConnEvent)
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	wake chan struct{}
+}
+
+// A SupervisorOption configures a Supervisor.
+type SupervisorOption func(s *Supervisor)
+
+// ClientOptions configures each client created by the Supervisor.
+func ClientOptions(opts ...Option) SupervisorOption {
+	return func(s *Supervisor) {
+		s.newClient = func() (*Client, error) {
+			return New(opts...)
+		}
+	}
+}
+
+// NewClientOption sets the function creating the client for each
+// connection attempt, for options that may change between attempts.
+func NewClientOption(f func() (*Client, error)) SupervisorOption {
+	return func(s *Supervisor) {
+		s.newClient = f
+	}
+}
+
+// BackoffOption sets the wait after the first failure, doubling with
+// each further failure up to max. The wait starts again from min once
+// a connection stays up for max, so that a connection which keeps
+// dropping straight after coming up still backs off. The default is 1s
+// to 1m.
+func BackoffOption(min, max time.Duration) SupervisorOption {
+	return func(s *Supervisor) {
+		s.minBackoff, s.maxBackoff = min, max
+	}
+}
+
+// JitterOption randomises each wait by up to fraction either way, so
+// that clients do not retry in step. The default is 0.2.
+func JitterOption(fraction float64) SupervisorOption {
+	return func(s *Supervisor) {
+		s.jitter = fraction
+	}
+}
+
+// MaxAttemptsOption limits the attempts to connect without the
+// connection staying up, after which Run gives up. Zero, the default,
+// is no limit.
+func MaxAttemptsOption(n int) SupervisorOption {
+	return func(s *Supervisor) {
+		s.maxAttempts = n
+	}
+}
+
+// BadEncodingLimitOption sets the bad encoding messages allowed before
+// the connection is dropped. The count resets after window without
+// one. The default is 50 within 15s.
+func BadEncodingLimitOption(limit int, window time.Duration) SupervisorOption {
+	return func(s *Supervisor) {
+		s.badEncodingLimit, s.badEncodingWindow = limit, window
+	}
+}
+
+// EventOption sets a function called with each connection event. It
+// is called from Run, so should not block.
+func EventOption(f func(ConnEvent)) SupervisorOption {
+	return func(s *Supervisor) {
+		s.onEvent = f
+	}
+}
+
+// NewSupervisor returns a new Supervisor, not yet running.
+func NewSupervisor(opts ...SupervisorOption) *Supervisor {
+	s := &Supervisor{
+		newClient:         func() (*Client, error) { return New() },
+		minBackoff:        time.Second,
+		maxBackoff:        time.Minute,
+		jitter:            0.2,
+		badEncodingLimit:  50,
+		badEncodingWindow: 15 * time.Second,
+		rand:              rand.New(rand.NewSource(time.Now().UnixNano())),
+		wake:              make(chan struct{}, 1),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// SetBackoff changes the backoff as BackoffOption. It is safe to call
+// while running.
+func (s *Supervisor) SetBackoff(min, max time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.minBackoff, s.maxBackoff = min, max
+}
+
+// Wake cuts short the wait before the next attempt to connect.
+func (s *Supervisor) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run connects to the car, then calls session with the started client.
+// The connection is closed when session returns. If session returns an
+// error, such as ErrClosed when the client's Recv channel closes, Run
+// reconnects after a backoff and calls session again. Run returns nil
+// once session returns nil, or ctx.Err() once ctx is done. With
+// MaxAttemptsOption, it also returns the last error on giving up.
+func (s *Supervisor) Run(ctx context.Context, session func(ctx context.Context, c *Client) error) error {
+	attempt, failures := 0, 0
+	for {
+		attempt++
+		c, err := s.connect(ctx, attempt)
+		up := err == nil
+		var upAt time.Time
+		if up {
+			upAt = time.Now()
+			if err = s.serve(ctx, c, session); err == nil {
+				s.emit(ConnEvent{State: ConnDown, Attempt: attempt})
+				return nil
+			}
+		}
+		down := ConnEvent{State: ConnDown, Attempt: attempt, Err: err}
+		if up && s.stayedUp(time.Since(upAt)) {
+			// Count attempts and back off afresh after staying up.
+			attempt, failures = 0, 0
+		}
+		failures++
+		if ctx.Err() != nil {
+			down.Err = ctx.Err()
+			s.emit(down)
+			return ctx.Err()
+		}
+		if s.maxAttempts > 0 && failures >= s.maxAttempts {
+			s.emit(down)
+			return err
+		}
+		down.Retry = s.backoff(failures)
+		s.emit(down)
+		timer := time.NewTimer(down.Retry)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// connect creates, connects and starts a client.
+func (s *Supervisor) connect(ctx context.Context, attempt int) (*Client, error) {
+	c, err := s.newClient()
+	if err != nil {
+		return nil, err
+	}
+	s.emit(ConnEvent{State: ConnConnecting, Attempt: attempt})
+	if err := c.ConnectContext(ctx); err != nil {
+		return nil, err
+	}
+	s.emit(ConnEvent{State: ConnHandshaking, Attempt: attempt})
+	// Nothing reads Recv until the session, so discard messages up to
+	// the start request, such as ping responses, so that the reader
+	// does not block during the handshake.
+	stop := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for {
+			select {
+			case <-stop:
+				return
+			case m, ok := <-c.Recv:
+				if !ok {
+					return
+				}
+				switch m.Type {
+				case protocol.CmdInMy24StartReq, protocol.CmdInMy18StartReq, protocol.CmdInMy14StartReq:
+					return
+				}
+			}
+		}
+	}()
+	if err := c.StartContext(ctx); err != nil {
+		close(stop)
+		<-drained
+		c.Close()
+		return nil, err
+	}
+	<-drained
+	s.emit(ConnEvent{State: ConnUp, Attempt: attempt})
+	return c, nil
+}
+
+// serve runs session on a started client, closing the client if the
+// car sends too many bad encoding messages.
+func (s *Supervisor) serve(ctx context.Context, c *Client, session func(ctx context.Context, c *Client) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer c.Close()
+
+	dropped := make(chan error, 1)
+	l := c.Subscribe(
+		NameOption("bad encoding"),
+		TypeFilterOption(protocol.CmdInBadEncoding),
+		BufferSizeOption(16),
+	)
+	defer c.RemoveListener(l)
+	go func() {
+		count := 0
+		var last time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-l.C:
+				if !ok {
+					return
+				}
+				if time.Since(last) > s.badEncodingWindow {
+					count = 0
+				}
+				count++
+				last = time.Now()
+				if s.badEncodingLimit > 0 && count > s.badEncodingLimit {
+					dropped <- &BadEncodingError{Count: count, Window: s.badEncodingWindow}
+					c.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	err := session(ctx, c)
+	select {
+	case reason := <-dropped:
+		return reason
+	default:
+	}
+	return err
+}
+
+// stayedUp returns whether a connection up for d was up long enough to
+// back off afresh after it, which is as long as the longest wait.
+func (s *Supervisor) stayedUp(d time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return d >= s.maxBackoff
+}
+
+// backoff returns the wait after the given number of failures.
+func (s *Supervisor) backoff(failures int) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wait := s.minBackoff
+	for i := 1; i < failures && wait < s.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > s.maxBackoff {
+		wait = s.maxBackoff
+	}
+	if s.jitter > 0 {
+		wait += time.Duration(float64(wait) * s.jitter * (2*s.rand.Float64() - 1))
+	}
+	return wait
+}
+
+func (s *Supervisor) emit(e ConnEvent) {
+	if s.onEvent == nil {
+		return
+	}
+	e.Time = time.Now()
+	s.onEvent(e)
+}
@@ -0,0 +1,245 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/emulator"
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// failingClients returns a NewClientOption whose clients fail to
+// connect, as nothing listens on their address.
+func failingClients(t *testing.T) client.SupervisorOption {
+	address := freeAddress(t)
+	return client.NewClientOption(func() (*client.Client, error) {
+		return client.New(client.AddressOption(address))
+	})
+}
+
+// carClients returns a NewClientOption whose clients each connect to
+// car.
+func carClients(t *testing.T, car *emulator.Car) client.SupervisorOption {
+	address := beginCar(t, car)
+	return client.NewClientOption(func() (*client.Client, error) {
+		return client.New(client.AddressOption(address))
+	})
+}
+
+func TestSupervisorEvents(t *testing.T) {
+	t.Parallel()
+	car, err := emulator.NewCar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []client.ConnEvent
+	s := client.NewSupervisor(carClients(t, car), client.EventOption(func(e client.ConnEvent) {
+		events = append(events, e)
+	}))
+	err = s.Run(context.Background(), func(ctx context.Context, c *client.Client) error {
+		if c.ModelYear() != client.ModelYear18 {
+			t.Errorf("ModelYear() = %v, want %v", c.ModelYear(), client.ModelYear18)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	want := []client.ConnState{client.ConnConnecting, client.ConnHandshaking, client.ConnUp, client.ConnDown}
+	if len(events) != len(want) {
+		t.Fatalf("got events %v, want states %v", events, want)
+	}
+	for i, e := range events {
+		if e.State != want[i] || e.Attempt != 1 {
+			t.Errorf("event %d = %v, want %v (attempt 1)", i, e, want[i])
+		}
+	}
+	if down := events[len(events)-1]; down.Err != nil || down.Retry != 0 {
+		t.Errorf("last event = %v, want no error or retry", down)
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	var downs []client.ConnEvent
+	connecting := 0
+	s := client.NewSupervisor(
+		failingClients(t),
+		client.BackoffOption(10*time.Millisecond, 40*time.Millisecond),
+		client.JitterOption(0),
+		client.MaxAttemptsOption(5),
+		client.EventOption(func(e client.ConnEvent) {
+			switch e.State {
+			case client.ConnConnecting:
+				connecting++
+			case client.ConnDown:
+				downs = append(downs, e)
+			}
+		}),
+	)
+	err := s.Run(context.Background(), func(ctx context.Context, c *client.Client) error {
+		t.Error("session called without a connection")
+		return nil
+	})
+	if err == nil {
+		t.Errorf("Run() = nil, want the dial error")
+	}
+	if connecting != 5 {
+		t.Errorf("connected %d times, want 5", connecting)
+	}
+	want := []time.Duration{10, 20, 40, 40, 0}
+	if len(downs) != len(want) {
+		t.Fatalf("got %d down events, want %d", len(downs), len(want))
+	}
+	for i, e := range downs {
+		if e.Retry != want[i]*time.Millisecond || e.Attempt != i+1 || e.Err == nil {
+			t.Errorf("down event %d = %v, want attempt %d retrying in %v", i, e, i+1, want[i]*time.Millisecond)
+		}
+	}
+}
+
+func TestSupervisorFlappingBackoff(t *testing.T) {
+	t.Parallel()
+	car, err := emulator.NewCar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var downs []client.ConnEvent
+	s := client.NewSupervisor(
+		carClients(t, car),
+		client.BackoffOption(10*time.Millisecond, time.Minute),
+		client.JitterOption(0),
+		client.EventOption(func(e client.ConnEvent) {
+			if e.State != client.ConnDown {
+				return
+			}
+			if downs = append(downs, e); len(downs) == 3 {
+				cancel()
+			}
+		}),
+	)
+	// Each session comes up, then ends with an error straight away.
+	flap := errors.New("connection dropped")
+	err = s.Run(ctx, func(ctx context.Context, c *client.Client) error {
+		return flap
+	})
+	if err != context.Canceled {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+	want := []time.Duration{10, 20, 40}
+	if len(downs) != len(want) {
+		t.Fatalf("got %d down events, want %d", len(downs), len(want))
+	}
+	for i, e := range downs {
+		if e.Retry != want[i]*time.Millisecond || e.Attempt != i+1 || e.Err != flap {
+			t.Errorf("down event %d = %v, want attempt %d retrying in %v", i, e, i+1, want[i]*time.Millisecond)
+		}
+	}
+}
+
+func TestSupervisorJitter(t *testing.T) {
+	var retries []time.Duration
+	s := client.NewSupervisor(
+		failingClients(t),
+		client.BackoffOption(10*time.Millisecond, 10*time.Millisecond),
+		client.JitterOption(0.5),
+		client.MaxAttemptsOption(10),
+		client.EventOption(func(e client.ConnEvent) {
+			if e.State == client.ConnDown && e.Retry > 0 {
+				retries = append(retries, e.Retry)
+			}
+		}),
+	)
+	s.Run(context.Background(), nil)
+	for _, r := range retries {
+		if r < 5*time.Millisecond || r > 15*time.Millisecond {
+			t.Errorf("retry in %v, want 5ms to 15ms", r)
+		}
+	}
+}
+
+func TestSupervisorWake(t *testing.T) {
+	var s *client.Supervisor
+	s = client.NewSupervisor(
+		failingClients(t),
+		client.BackoffOption(time.Hour, time.Hour),
+		client.MaxAttemptsOption(2),
+		client.EventOption(func(e client.ConnEvent) {
+			if e.State == client.ConnDown && e.Retry > 0 {
+				s.Wake()
+			}
+		}),
+	)
+	done := make(chan error)
+	go func() {
+		done <- s.Run(context.Background(), nil)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Run() = nil, want the dial error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wake() did not cut short the backoff")
+	}
+}
+
+func TestSupervisorContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := client.NewSupervisor(
+		failingClients(t),
+		client.BackoffOption(time.Hour, time.Hour),
+		client.EventOption(func(e client.ConnEvent) {
+			if e.State == client.ConnDown {
+				cancel()
+			}
+		}),
+	)
+	if err := s.Run(ctx, nil); err != context.Canceled {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSupervisorBadEncoding(t *testing.T) {
+	t.Parallel()
+	car, err := emulator.NewCar(emulator.WriteHandlerOption(func(m *protocol.PhevMessage) emulator.WriteResponse {
+		return emulator.WriteBadEncoding
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var down client.ConnEvent
+	s := client.NewSupervisor(
+		carClients(t, car),
+		client.BadEncodingLimitOption(3, time.Minute),
+		client.MaxAttemptsOption(1),
+		client.EventOption(func(e client.ConnEvent) {
+			if e.State == client.ConnDown {
+				down = e
+			}
+		}),
+	)
+	err = s.Run(context.Background(), func(ctx context.Context, c *client.Client) error {
+		go func() {
+			for range c.Recv {
+			}
+		}()
+		// Each bad encoding reply is retried, until the supervisor
+		// closes the connection.
+		return c.SetRegisterContext(ctx, 0x0a, []byte{0x1})
+	})
+	var bad *client.BadEncodingError
+	if !errors.As(err, &bad) {
+		t.Fatalf("Run() = %v, want a *BadEncodingError", err)
+	}
+	if bad.Count != 4 {
+		t.Errorf("Count = %d, want 4", bad.Count)
+	}
+	if down.Err != err {
+		t.Errorf("down event error = %v, want %v", down.Err, err)
+	}
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/protocol/commands"
+)
+
+// ClimateMode is the pre-conditioning mode.
+type ClimateMode = protocol.ClimateMode
+
+const (
+	ClimateOff        = protocol.ClimateOff
+	ClimateCool       = protocol.ClimateCool
+	ClimateHeat       = protocol.ClimateHeat
+	ClimateWindscreen = protocol.ClimateWindscreen
+)
+
+// A Vehicle sends typed commands to the car through a started Client,
+// choosing the encoding for the model year the car announced.
+type Vehicle struct {
+	c *Client
+}
+
+// NewVehicle returns a Vehicle commanding the car through c.
+func NewVehicle(c *Client) *Vehicle {
+	return &Vehicle{c: c}
+}
+
+// Client returns the client the Vehicle sends commands through.
+func (v *Vehicle) Client() *Client {
+	return v.c
+}
+
+// ModelYear returns the model year the car announced, or
+// ModelYearUnknown before the client has started.
+func (v *Vehicle) ModelYear() ModelYear {
+	return v.c.ModelYear()
+}
+
+// send writes each message in turn, stopping at the first failure.
+func (v *Vehicle) send(ctx context.Context, msgs ...*protocol.PhevMessage) error {
+	for _, m := range msgs {
+		if err := v.c.SetRegisterContext(ctx, m.Register, m.Data); err != nil {
+			return fmt.Errorf("setting register 0x%02x: %v", m.Register, err)
+		}
+	}
+	return nil
+}
+
+// wholeMinutes converts d to minutes, for the climate commands.
+func wholeMinutes(d time.Duration) (int, error) {
+	if d < 0 || d%time.Minute != 0 {
+		return 0, fmt.Errorf("not a whole number of minutes: %v", d)
+	}
+	return int(d / time.Minute), nil
+}
+
+// StartClimate runs the climate in mode for duration (10, 20 or 30
+// minutes) after delay (0, 5 or 10 minutes). MY'14 cars do not support
+// a delay.
+func (v *Vehicle) StartClimate(ctx context.Context, mode ClimateMode, duration, delay time.Duration) error {
+	minutes, err := wholeMinutes(duration)
+	if err != nil {
+		return fmt.Errorf("climate duration: %v", err)
+	}
+	after, err := wholeMinutes(delay)
+	if err != nil {
+		return fmt.Errorf("climate delay: %v", err)
+	}
+	msgs, err := commands.ClimateFor(v.ModelYear(), mode, minutes, after)
+	if err != nil {
+		return err
+	}
+	return v.send(ctx, msgs...)
+}
+
+// StopClimate switches the climate off.
+func (v *Vehicle) StopClimate(ctx context.Context) error {
+	msgs, err := commands.ClimateFor(v.ModelYear(), ClimateOff, 0, 0)
+	if err != nil {
+		return err
+	}
+	return v.send(ctx, msgs...)
+}
+
+// ResetClimateState acknowledges a terminated pre-conditioning.
+func (v *Vehicle) ResetClimateState(ctx context.Context) error {
+	return v.send(ctx, commands.PreACReset())
+}
+
+// SetHeadlights switches the headlights on or off.
+func (v *Vehicle) SetHeadlights(ctx context.Context, on bool) error {
+	return v.send(ctx, commands.Headlights(on))
+}
+
+// SetParkingLights switches the parking lights on or off.
+func (v *Vehicle) SetParkingLights(ctx context.Context, on bool) error {
+	return v.send(ctx, commands.ParkingLights(on))
+}
+
+// CancelChargeTimer cancels the charge timer, so charging starts
+// immediately.
+func (v *Vehicle) CancelChargeTimer(ctx context.Context) error {
+	return v.send(ctx, commands.CancelChargeTimer()...)
+}
+
+// RequestUpdate asks the car to resend all registers.
+func (v *Vehicle) RequestUpdate(ctx context.Context) error {
+	return v.send(ctx, commands.RequestUpdate())
+}
+
+// Register registers this client's MAC address with the car, which must
+// be in registration mode.
+func (v *Vehicle) Register(ctx context.Context) error {
+	return v.send(ctx, commands.RegisterClient())
+}
+
+// Unregister removes this client's registration from the car.
+func (v *Vehicle) Unregister(ctx context.Context) error {
+	return v.send(ctx, commands.UnregisterClient())
+}
+
+// SyncTime sets the car clock to t.
+func (v *Vehicle) SyncTime(ctx context.Context, t time.Time) error {
+	m, err := commands.SyncTime(t, false)
+	if err != nil {
+		return err
+	}
+	return v.send(ctx, m)
+}
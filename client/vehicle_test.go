@@ -0,0 +1,91 @@
+package client_test
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/emulator"
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+func TestVehicleStartClimate(t *testing.T) {
+	tests := []struct {
+		year     client.ModelYear
+		mode     client.ClimateMode
+		duration time.Duration
+		delay    time.Duration
+		want     []string
+		// invalid are delays the model year rejects.
+		invalid []time.Duration
+	}{
+		{
+			year:     client.ModelYear18,
+			mode:     client.ClimateHeat,
+			duration: 10 * time.Minute,
+			delay:    5 * time.Minute,
+			want:     []string{"1b:02020001"},
+			invalid:  []time.Duration{3 * time.Minute, 90 * time.Second, -5 * time.Minute},
+		}, {
+			year:     client.ModelYear14,
+			mode:     client.ClimateCool,
+			duration: 30 * time.Minute,
+			want:     []string{"02:0000ffffffff03ffffffffffffffff", "04:02"},
+			invalid:  []time.Duration{5 * time.Minute},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.year.String(), func(t *testing.T) {
+			t.Parallel()
+			var mu sync.Mutex
+			var writes []string
+			car, err := emulator.NewCar(
+				emulator.ModelYearOption(test.year),
+				emulator.WriteHandlerOption(func(m *protocol.PhevMessage) emulator.WriteResponse {
+					mu.Lock()
+					defer mu.Unlock()
+					writes = append(writes, fmt.Sprintf("%02x:%s", m.Register, hex.EncodeToString(m.Data)))
+					return emulator.WriteAck
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := client.NewVehicle(startCar(t, car))
+			if got := v.ModelYear(); got != test.year {
+				t.Fatalf("ModelYear() = %v, want %v", got, test.year)
+			}
+			ctx := context.Background()
+			if err := v.StartClimate(ctx, test.mode, test.duration, test.delay); err != nil {
+				t.Fatalf("StartClimate() = %v", err)
+			}
+			mu.Lock()
+			got := append([]string{}, writes...)
+			mu.Unlock()
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("StartClimate() wrote %v, want %v", got, test.want)
+			}
+
+			// Invalid arguments fail before anything is written.
+			for _, d := range []time.Duration{15 * time.Minute, 90 * time.Second, -10 * time.Minute} {
+				if err := v.StartClimate(ctx, test.mode, d, 0); err == nil {
+					t.Errorf("StartClimate() duration %v succeeded", d)
+				}
+			}
+			for _, d := range test.invalid {
+				if err := v.StartClimate(ctx, test.mode, 10*time.Minute, d); err == nil {
+					t.Errorf("StartClimate() delay %v succeeded", d)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(writes) != len(test.want) {
+				t.Errorf("invalid StartClimate() wrote %v", writes[len(test.want):])
+			}
+		})
+	}
+}
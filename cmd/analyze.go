@@ -0,0 +1,211 @@
+/*
+Copyright © 2021 Ben Buxton <bbuxton@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/protocol"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// analyzeCmd represents the analyze command
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze",
+	Short: "Analyze register changes bit by bit",
+	Long: `Reports, per register and bit, each time the value changed,
+to help decode registers that are not yet understood.
+
+Changes are lined up with event markers, given as "<time> <label>",
+e.g. --event "12:01:03 opened driver door". A time of day is taken to
+be on the day of the first message. Changes within --window of an
+event are reported against it.
+
+See subcommands for the message sources.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+var analyzeFileCmd = &cobra.Command{
+	Use:   "file <filename>",
+	Short: "Analyze messages from a hex file",
+	Long: `Analyze raw hex messages from a file, one or more per line.
+Lines may be prefixed with the time they were received, in the same
+format as for events, e.g. "12:01:03.250 6f0c00...".`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		a := newAnalyzer(cmd)
+		securityKey = newSecurityKey(cmd, nil)
+		now := time.Now()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			var t time.Time
+			if e, err := protocol.ParseEvent(line, now); err == nil {
+				t, line = e.Time, e.Label
+			}
+			data, err := hex.DecodeString(line)
+			if err != nil {
+				log.Errorf("Not a valid hex string [%s]: %v", line, err)
+				continue
+			}
+			for _, msg := range decodeMessages(data) {
+				a.Add(msg, t)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatal(err)
+		}
+		analyzeReport(cmd, a)
+		logDecodeHealth()
+	},
+}
+
+var analyzeLiveCmd = &cobra.Command{
+	Use:   "live",
+	Short: "Analyze messages from the car",
+	Long: `Connects to the car and analyzes register updates until
+--duration passes or interrupted. Each line typed on stdin is added as
+an event at the time it is entered.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		duration, _ := cmd.Flags().GetDuration("duration")
+
+		a := newAnalyzer(cmd)
+		events := make(chan protocol.Event)
+		go func() {
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				if label := strings.TrimSpace(scanner.Text()); label != "" {
+					events <- protocol.Event{Time: time.Now(), Label: label}
+				}
+			}
+		}()
+		// Reconnects if the connection drops, until --duration passes
+		// or interrupted.
+		ctx, cancel := context.WithTimeout(context.Background(), duration)
+		defer cancel()
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		defer signal.Stop(interrupt)
+		go func() {
+			select {
+			case <-interrupt:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := newSupervisor(cmd).Run(ctx, func(ctx context.Context, cl *client.Client) error {
+			defer func() {
+				log.Infof("Protocol health: %s", cl.Health())
+			}()
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case m, ok := <-cl.Recv:
+					if !ok {
+						log.Infof("Connection closed.")
+						return client.ErrClosed
+					}
+					if m.Type != protocol.CmdInResp || m.Ack != protocol.Request {
+						continue
+					}
+					for _, c := range a.Add(m, time.Now()) {
+						log.Infof("%%PHEV_BIT_CHANGE%% %s", c)
+					}
+					cl.Send <- &protocol.PhevMessage{
+						Type:     protocol.CmdOutSend,
+						Register: m.Register,
+						Ack:      protocol.Ack,
+						Xor:      m.Xor,
+						Data:     []byte{0x0},
+					}
+				case e := <-events:
+					log.Infof("Event: %s", e.Label)
+					a.AddEvent(e)
+				}
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Fatal(err)
+		}
+		analyzeReport(cmd, a)
+	},
+}
+
+func newAnalyzer(cmd *cobra.Command) *protocol.Analyzer {
+	a := protocol.NewAnalyzer()
+	a.Window, _ = cmd.Flags().GetDuration("window")
+	return a
+}
+
+// analyzeReport adds the event markers from the flags, then writes the
+// analysis to stdout.
+func analyzeReport(cmd *cobra.Command, a *protocol.Analyzer) {
+	ref := a.Start()
+	if ref.IsZero() {
+		ref = time.Now()
+	}
+	events, _ := cmd.Flags().GetStringArray("event")
+	if filename, _ := cmd.Flags().GetString("events"); filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				events = append(events, line)
+			}
+		}
+	}
+	for _, s := range events {
+		e, err := protocol.ParseEvent(s, ref)
+		if err != nil {
+			log.Errorf("Invalid event: %v", err)
+			continue
+		}
+		a.AddEvent(e)
+	}
+	a.Report(os.Stdout)
+}
+
+func init() {
+	decodeCmd.AddCommand(analyzeCmd)
+	analyzeCmd.AddCommand(analyzeFileCmd)
+	analyzeCmd.AddCommand(analyzeLiveCmd)
+
+	analyzeCmd.PersistentFlags().StringArray("event", nil, "Event marker as \"<time> <label>\", may be repeated")
+	analyzeCmd.PersistentFlags().String("events", "", "File of event markers, one per line")
+	analyzeCmd.PersistentFlags().Duration("window", 5*time.Second, "How close a change must be to an event to relate to it")
+	analyzeLiveCmd.Flags().String("address", client.DefaultAddress, "Address to connect to")
+	analyzeLiveCmd.Flags().Duration("duration", 5*time.Minute, "How long to analyze for")
+}
@@ -0,0 +1,69 @@
+//go:build pcap
+
+/*
+Copyright © 2021 Ben Buxton <bbuxton@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var analyzePcapCmd = &cobra.Command{
+	Use:   "pcap <filename>",
+	Short: "Analyze messages from a PCAP traffic dump",
+	Long: `Analyze register updates sent by the car in a PCAP file,
+using the capture time of each packet.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		handle, err := pcap.OpenOffline(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer handle.Close()
+		securityKey = &protocol.SecurityKey{Logger: log.StandardLogger()}
+
+		a := newAnalyzer(cmd)
+		packets := gopacket.NewPacketSource(handle, handle.LinkType()).Packets()
+		if r, _ := cmd.Flags().GetBool("recover-key"); r {
+			packets = recoverKey(cmd, packets)
+		}
+		for packet := range packets {
+			tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			if !ok || tcp.SrcPort != 8080 {
+				continue
+			}
+			al := packet.ApplicationLayer()
+			if al == nil {
+				continue
+			}
+			for _, msg := range decodeMessages(al.Payload()) {
+				a.Add(msg, packet.Metadata().Timestamp)
+			}
+		}
+		analyzeReport(cmd, a)
+	},
+}
+
+func init() {
+	analyzeCmd.AddCommand(analyzePcapCmd)
+}
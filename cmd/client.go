@@ -17,6 +17,8 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"github.com/buxtronix/phev2mqtt/client"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -34,6 +36,18 @@ Requires Wifi reachability to the vehicle.`,
 	},
 }
 
+// newSupervisor returns a Supervisor connecting to --address, which
+// logs connection events.
+func newSupervisor(cmd *cobra.Command, opts ...client.SupervisorOption) *client.Supervisor {
+	address, _ := cmd.Flags().GetString("address")
+	return client.NewSupervisor(append([]client.SupervisorOption{
+		client.ClientOptions(client.AddressOption(address)),
+		client.EventOption(func(e client.ConnEvent) {
+			log.Infof("%%PHEV_CONNECTION%% %s", e)
+		}),
+	}, opts...)...)
+}
+
 func init() {
 	rootCmd.AddCommand(clientCmd)
 
@@ -17,6 +17,8 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"github.com/buxtronix/phev2mqtt/protocol"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
@@ -33,6 +35,41 @@ Subcommands provide specific functionality, see below.
 	},
 }
 
+// decodeHealth counts messages and decode errors over a decode run.
+var decodeHealth protocol.Health
+
+// decodeMessages decodes the messages in data, logging and counting
+// any decode errors.
+func decodeMessages(data []byte) []*protocol.PhevMessage {
+	msgs, errs := protocol.DecodeBytes(data, securityKey)
+	decodeHealth.Messages += len(msgs)
+	for _, err := range errs {
+		decodeHealth.Record(err)
+		log.Warnf("Decode error: %v", err)
+	}
+	return msgs
+}
+
+// newSecurityKey returns the key to decode data with. With
+// --recover-key, the key is recovered from data, for captures which
+// start after the security init message.
+func newSecurityKey(cmd *cobra.Command, data []byte) *protocol.SecurityKey {
+	if r, _ := cmd.Flags().GetBool("recover-key"); r {
+		key, err := protocol.RecoverKey(data)
+		if err == nil {
+			log.Infof("Recovered security key: %s", key)
+			key.Logger = log.StandardLogger()
+			return key
+		}
+		log.Warnf("Unable to recover security key: %v", err)
+	}
+	return &protocol.SecurityKey{Logger: log.StandardLogger()}
+}
+
+func logDecodeHealth() {
+	log.Infof("Protocol health: %s", decodeHealth)
+}
+
 func init() {
 	rootCmd.AddCommand(decodeCmd)
 
@@ -41,6 +78,7 @@ func init() {
 	// Cobra supports Persistent Flags which will work for this command
 	// and all subcommands, e.g.:
 	// decodeCmd.PersistentFlags().String("foo", "", "A help for foo")
+	decodeCmd.PersistentFlags().Bool("recover-key", false, "Recover the security key, for captures starting mid-session")
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
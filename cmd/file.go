@@ -53,11 +53,12 @@ Decode raw hex string messages from the provided filename.
 		if err != nil {
 			panic(err)
 		}
-		securityKey = &protocol.SecurityKey{}
-		for _, msg := range protocol.NewFromBytes(binData, securityKey) {
+		securityKey = newSecurityKey(cmd, binData)
+		for _, msg := range decodeMessages(binData) {
 			log.Debug(hex.EncodeToString(msg.Original))
 			log.Infof("%s", msg.ShortForm())
 		}
+		logDecodeHealth()
 	},
 }
 
@@ -17,8 +17,8 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"bytes"
 	"encoding/hex"
-	"github.com/buxtronix/phev2mqtt/protocol"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -31,18 +31,23 @@ var hexCmd = &cobra.Command{
 should be in hex format, e;g 'dc2b2f762f7f'.`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		securityKey = &protocol.SecurityKey{}
+		msgs := [][]byte{}
 		for _, arg := range args {
 			data, err := hex.DecodeString(arg)
 			if err != nil {
 				log.Errorf("Not a valid hex string [%s]: %v", arg, err)
 				continue
 			}
-			for _, msg := range protocol.NewFromBytes(data, securityKey) {
+			msgs = append(msgs, data)
+		}
+		securityKey = newSecurityKey(cmd, bytes.Join(msgs, nil))
+		for _, data := range msgs {
+			for _, msg := range decodeMessages(data) {
 				log.Debug(hex.EncodeToString(msg.Original))
 				log.Infof("%s", msg.ShortForm())
 			}
 		}
+		logDecodeHealth()
 	},
 }
 
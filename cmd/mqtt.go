@@ -17,13 +17,17 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
-	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/buxtronix/phev2mqtt/client"
@@ -237,7 +241,7 @@ more details on the topics.
 `,
 	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		mc := &mqttClient{climate: new(climate)}
+		mc := &mqttClient{climate: new(climate), state: client.NewState()}
 		return mc.Run(cmd, args)
 	},
 }
@@ -461,6 +465,9 @@ func (m *mqttClient) requestCommandConnect() {
 	case m.commandWake <- struct{}{}:
 	default:
 	}
+	if m.supervisor != nil {
+		m.supervisor.Wake()
+	}
 }
 
 func (m *mqttClient) setConnected(connected bool) {
@@ -495,6 +502,12 @@ func (m *mqttClient) waitForConnection(timeout time.Duration) bool {
 	}
 }
 
+// vehicle returns the car to send commands to, through the current
+// client.
+func (m *mqttClient) vehicle() *client.Vehicle {
+	return client.NewVehicle(m.phev)
+}
+
 func (m *mqttClient) ensureConnectedForCommand() bool {
 	m.ensureWifiOn()
 	if m.waitForConnection(m.remoteWifiPowerSaveWait + m.phevStartTimeout + 5*time.Second) {
@@ -511,8 +524,12 @@ type mqttClient struct {
 	updateInterval time.Duration
 
 	phev        *client.Client
+	supervisor  *client.Supervisor
 	lastConnect time.Time
 	lastError   error
+	// ctx is cancelled on shutdown, aborting any PHEV operation in
+	// flight.
+	ctx context.Context
 
 	prefix string
 
@@ -523,6 +540,8 @@ type mqttClient struct {
 
 	climate *climate
 	enabled bool
+	// state is the vehicle state, kept across connections.
+	state *client.State
 
 	// WiFi restart settings
 	wifiRestartTime          time.Duration
@@ -557,6 +576,7 @@ type mqttClient struct {
 	phevRegisterTimeout          time.Duration
 	phevTCPReadTimeout           time.Duration
 	phevTCPWriteTimeout          time.Duration
+	phevTimeSyncThreshold        time.Duration
 
 	// Configuration hot reload
 	configReloader *ConfigReloader
@@ -697,6 +717,9 @@ func (m *mqttClient) validateConfig() error {
 
 func (m *mqttClient) Run(cmd *cobra.Command, args []string) error {
 	m.enabled = true // Default.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	m.ctx = ctx
 	// Load .env file before reading config
 	configFile := GetConfigFilePath()
 	if configFile != "" {
@@ -843,6 +866,7 @@ func (m *mqttClient) Run(cmd *cobra.Command, args []string) error {
 	if m.phevTCPWriteTimeout == 0 {
 		m.phevTCPWriteTimeout = 15 * time.Second
 	}
+	m.phevTimeSyncThreshold = viper.GetDuration("phev_time_sync_threshold")
 
 	// Validate configuration
 	if err := m.validateConfig(); err != nil {
@@ -936,6 +960,22 @@ func (m *mqttClient) Run(cmd *cobra.Command, args []string) error {
 		powerSaveTicker = nil
 	}
 
+	// The supervisor connects to the PHEV, retrying with backoff. In
+	// power save mode each cycle makes a single attempt.
+	supervisorOpts := []client.SupervisorOption{
+		client.NewClientOption(m.newPhevClient),
+		client.BackoffOption(m.retryBackoff()),
+		client.BadEncodingLimitOption(50, m.encodingErrorResetInterval),
+		client.EventOption(func(e client.ConnEvent) {
+			m.onConnEvent(cmd, e)
+		}),
+	}
+	if powerSaveTicker != nil {
+		supervisorOpts = append(supervisorOpts, client.MaxAttemptsOption(1))
+	}
+	m.supervisor = client.NewSupervisor(supervisorOpts...)
+	m.lastConnect = time.Now()
+
 	for {
 		// Power save mode: turn WiFi on at each interval and wait for connection attempt
 		if powerSaveTicker != nil {
@@ -945,6 +985,8 @@ func (m *mqttClient) Run(cmd *cobra.Command, args []string) error {
 				log.Infof("[Power Save] Update cycle started - turning WiFi on")
 			case <-m.commandWake:
 				log.Infof("[Command] Connection requested, preparing to connect")
+			case <-ctx.Done():
+				return m.shutdown()
 			}
 			if m.remoteWifiPowerSaveEnabled && m.remoteWifiControlTopic != "" && !m.powerSaveWifiOn {
 				m.remoteWifiEnable()
@@ -956,26 +998,49 @@ func (m *mqttClient) Run(cmd *cobra.Command, args []string) error {
 		}
 
 		log.Infof("[Main Loop] Attempting to connect to PHEV...")
-		if err := m.handlePhev(cmd); err != nil {
-			// Connection failed - set enabled to false
-			if m.enabled {
-				log.Infof("[Main Loop] Connection failed, setting enabled=false")
-				m.enabled = false
-			}
-			// Do not flood the log with the same messages every second
-			if m.lastError == nil || m.lastError.Error() != err.Error() {
-				log.Errorf("PHEV connection error: %v", err)
-				m.lastError = err
-			}
-			// WiFi will be turned off by defer in handlePhev()
-		} else {
-			// Connection succeeded - ensure enabled is true
-			if !m.enabled {
-				log.Infof("[Main Loop] Connection succeeded, setting enabled=true")
-				m.enabled = true
-			}
+		m.supervisor.Run(ctx, m.handlePhev)
+		m.powerSaveWifiOff()
+		if ctx.Err() != nil {
+			return m.shutdown()
 		}
+	}
+}
 
+// retryBackoff returns the backoff between connection attempts, up to
+// connection_retry_interval.
+func (m *mqttClient) retryBackoff() (time.Duration, time.Duration) {
+	min := 5 * time.Second
+	if min > m.connectionRetryInterval {
+		min = m.connectionRetryInterval
+	}
+	return min, m.connectionRetryInterval
+}
+
+// onConnEvent tracks the state of the PHEV connection, and while it
+// is down publishes the bridge offline and restarts WiFi as configured.
+func (m *mqttClient) onConnEvent(cmd *cobra.Command, e client.ConnEvent) {
+	log.Infof("[Connection] %s", e)
+	switch e.State {
+	case client.ConnUp:
+		// Connection succeeded - ensure enabled is true
+		if !m.enabled {
+			log.Infof("[Main Loop] Connection succeeded, setting enabled=true")
+			m.enabled = true
+		}
+	case client.ConnDown:
+		if e.Err == nil || errors.Is(e.Err, context.Canceled) {
+			return
+		}
+		// Connection failed - set enabled to false
+		if m.enabled {
+			log.Infof("[Main Loop] Connection failed, setting enabled=false")
+			m.enabled = false
+		}
+		// Do not flood the log with the same messages every second
+		if m.lastError == nil || m.lastError.Error() != e.Err.Error() {
+			log.Errorf("PHEV connection error: %v", e.Err)
+			m.lastError = e.Err
+		}
 		// Publish as offline if last connection was >availability_offline_timeout ago.
 		if time.Now().Sub(m.lastConnect) > m.availabilityOfflineTimeout {
 			m.client.Publish(m.topic("/available"), 0, true, "offline")
@@ -986,19 +1051,17 @@ func (m *mqttClient) Run(cmd *cobra.Command, args []string) error {
 				log.Errorf("Error during WiFi restart: %v", err)
 			}
 		}
-
-		// Only sleep between retries when NOT in power save mode
-		// In power save mode, we block on the ticker at the start of the loop
-		if powerSaveTicker == nil {
-			select {
-			case <-time.After(m.connectionRetryInterval):
-			case <-m.commandWake:
-				log.Infof("[Command] Connection requested, bypassing retry wait")
-			}
-		}
 	}
 }
 
+// shutdown publishes the bridge as offline and disconnects from MQTT.
+func (m *mqttClient) shutdown() error {
+	log.Infof("Shutting down")
+	m.client.Publish(m.topic("/available"), 0, true, "offline").Wait()
+	m.client.Disconnect(250)
+	return nil
+}
+
 func (m *mqttClient) publish(topic, payload string) {
 	if cache := m.mqttData[topic]; cache == payload {
 		return
@@ -1007,6 +1070,18 @@ func (m *mqttClient) publish(topic, payload string) {
 	m.mqttData[topic] = payload
 }
 
+// publishHealth publishes the decode statistics for the connection.
+func (m *mqttClient) publishHealth() {
+	health := m.phev.Health()
+	data, err := json.Marshal(health)
+	if err != nil {
+		log.Errorf("Error encoding protocol health: %v", err)
+		return
+	}
+	m.publish("/protocol/health", string(data))
+	m.publish("/protocol/errors", fmt.Sprintf("%d", health.Errors()))
+}
+
 func (m *mqttClient) handleIncomingMqtt(mqtt_client mqtt.Client, msg mqtt.Message) {
 	log.Infof("Topic: [%s] Payload: [%s]", msg.Topic(), msg.Payload())
 
@@ -1033,7 +1108,7 @@ func (m *mqttClient) handleIncomingMqtt(mqtt_client mqtt.Client, msg mqtt.Messag
 			log.Warnf("PHEV client not connected, cannot set register %02x", register[0])
 			return
 		}
-		if err := m.phev.SetRegister(register[0], data); err != nil {
+		if err := m.phev.SetRegisterContext(m.ctx, register[0], data); err != nil {
 			log.Infof("Error setting register %02x: %v", register[0], err)
 			return
 		}
@@ -1061,7 +1136,7 @@ func (m *mqttClient) handleIncomingMqtt(mqtt_client mqtt.Client, msg mqtt.Messag
 			log.Warnf("[Connection Control] Unknown connection command: '%s'", payload)
 		}
 	} else if msg.Topic() == m.topic("/set/parkinglights") {
-		values := map[string]byte{"on": 0x1, "off": 0x2}
+		values := map[string]bool{"on": true, "off": false}
 		if v, ok := values[strings.ToLower(string(msg.Payload()))]; ok {
 			if !m.ensureConnectedForCommand() {
 				return
@@ -1070,13 +1145,13 @@ func (m *mqttClient) handleIncomingMqtt(mqtt_client mqtt.Client, msg mqtt.Messag
 				log.Warnf("PHEV client not connected, cannot set parking lights")
 				return
 			}
-			if err := m.phev.SetRegister(0xb, []byte{v}); err != nil {
-				log.Infof("Error setting register 0xb: %v", err)
+			if err := m.vehicle().SetParkingLights(m.ctx, v); err != nil {
+				log.Infof("Error setting parking lights: %v", err)
 				return
 			}
 		}
 	} else if msg.Topic() == m.topic("/set/headlights") {
-		values := map[string]byte{"on": 0x1, "off": 0x2}
+		values := map[string]bool{"on": true, "off": false}
 		if v, ok := values[strings.ToLower(string(msg.Payload()))]; ok {
 			if !m.ensureConnectedForCommand() {
 				return
@@ -1085,8 +1160,8 @@ func (m *mqttClient) handleIncomingMqtt(mqtt_client mqtt.Client, msg mqtt.Messag
 				log.Warnf("PHEV client not connected, cannot set headlights")
 				return
 			}
-			if err := m.phev.SetRegister(0xa, []byte{v}); err != nil {
-				log.Infof("Error setting register 0xb: %v", err)
+			if err := m.vehicle().SetHeadlights(m.ctx, v); err != nil {
+				log.Infof("Error setting headlights: %v", err)
 				return
 			}
 		}
@@ -1098,12 +1173,8 @@ func (m *mqttClient) handleIncomingMqtt(mqtt_client mqtt.Client, msg mqtt.Messag
 			log.Warnf("PHEV client not connected, cannot cancel charge timer")
 			return
 		}
-		if err := m.phev.SetRegister(0x17, []byte{0x1}); err != nil {
-			log.Infof("Error setting register 0x17: %v", err)
-			return
-		}
-		if err := m.phev.SetRegister(0x17, []byte{0x11}); err != nil {
-			log.Infof("Error setting register 0x17: %v", err)
+		if err := m.vehicle().CancelChargeTimer(m.ctx); err != nil {
+			log.Infof("Error cancelling charge timer: %v", err)
 			return
 		}
 	} else if strings.HasPrefix(msg.Topic(), m.topic("/set/climate/state")) {
@@ -1116,7 +1187,7 @@ func (m *mqttClient) handleIncomingMqtt(mqtt_client mqtt.Client, msg mqtt.Messag
 				log.Warnf("PHEV client not connected, cannot reset climate state")
 				return
 			}
-			if err := m.phev.SetRegister(protocol.SetAckPreACTermRegister, []byte{0x1}); err != nil {
+			if err := m.vehicle().ResetClimateState(m.ctx); err != nil {
 				log.Infof("Error acknowledging Pre-AC termination: %v", err)
 				return
 			}
@@ -1125,8 +1196,8 @@ func (m *mqttClient) handleIncomingMqtt(mqtt_client mqtt.Client, msg mqtt.Messag
 		topic := msg.Topic()
 		payload := strings.ToLower(string(msg.Payload()))
 
-		modeMap := map[string]byte{"off": 0x0, "OFF": 0x0, "cool": 0x1, "heat": 0x2, "windscreen": 0x3, "mode": 0x4}
-		durMap := map[string]byte{"10": 0x0, "20": 0x1, "30": 0x2, "on": 0x0, "off": 0x0}
+		modeMap := map[string]protocol.ClimateMode{"off": protocol.ClimateOff, "OFF": protocol.ClimateOff, "cool": protocol.ClimateCool, "heat": protocol.ClimateHeat, "windscreen": protocol.ClimateWindscreen, "mode": 0x4}
+		durMap := map[string]int{"10": 10, "20": 20, "30": 30, "on": 10, "off": 10}
 		parts := strings.Split(topic, "/")
 		mode, ok := modeMap[parts[len(parts)-1]]
 		if !ok {
@@ -1153,35 +1224,15 @@ func (m *mqttClient) handleIncomingMqtt(mqtt_client mqtt.Client, msg mqtt.Messag
 			log.Warnf("PHEV client not connected, cannot set climate mode")
 			return
 		}
-		if m.phev.ModelYear == client.ModelYear14 {
-			// Set the AC mode first
-			registerPayload := bytes.Repeat([]byte{0xff}, 15)
-			registerPayload[0] = 0x0
-			registerPayload[1] = 0x0
-			registerPayload[6] = mode | duration
-			if err := m.phev.SetRegister(protocol.SetACModeRegisterMY14, registerPayload); err != nil {
-				log.Infof("Error setting AC mode: %v", err)
-				return
-			}
-
-			// Then, enable/disable the AC
-			acEnabled := byte(0x02)
-			if mode == 0x0 {
-				acEnabled = 0x01
-			}
-			if err := m.phev.SetRegister(protocol.SetACEnabledRegisterMY14, []byte{acEnabled}); err != nil {
-				log.Infof("Error setting AC enabled state: %v", err)
-				return
-			}
-		} else if m.phev.ModelYear == client.ModelYear18 || m.phev.ModelYear == client.ModelYear24 {
-			state := byte(0x02)
-			if mode == 0x0 {
-				state = 0x1
-			}
-			if err := m.phev.SetRegister(protocol.SetACModeRegisterMY18, []byte{state, mode, duration, 0x0}); err != nil {
-				log.Infof("Error setting AC mode: %v", err)
-				return
-			}
+		var err error
+		if mode == protocol.ClimateOff {
+			err = m.vehicle().StopClimate(m.ctx)
+		} else {
+			err = m.vehicle().StartClimate(m.ctx, mode, time.Duration(duration)*time.Minute, 0)
+		}
+		if err != nil {
+			log.Infof("Error setting AC mode: %v", err)
+			return
 		}
 	} else if msg.Topic() == m.topic("/settings/dump") {
 		if m.phev == nil {
@@ -1328,12 +1379,16 @@ func (m *mqttClient) onConfigReload() {
 	if m.phevTCPWriteTimeout == 0 {
 		m.phevTCPWriteTimeout = 15 * time.Second
 	}
+	m.phevTimeSyncThreshold = viper.GetDuration("phev_time_sync_threshold")
 
 	// Validate configuration
 	if err := m.validateConfig(); err != nil {
 		log.Errorf("Configuration validation failed after reload: %v", err)
 		return
 	}
+	if m.supervisor != nil {
+		m.supervisor.SetBackoff(m.retryBackoff())
+	}
 
 	log.Infof("Configuration reloaded:")
 	log.Infof("  update_interval: %v", m.updateInterval)
@@ -1348,58 +1403,60 @@ func (m *mqttClient) onConfigReload() {
 	}
 }
 
-func (m *mqttClient) handlePhev(cmd *cobra.Command) error {
-	// Ensure WiFi is turned off when function exits (on both success and failure)
-	defer func() {
-		m.setConnected(false)
-		m.lastConnect = time.Now()
-		// Turn WiFi off after connection ends in power save mode
-		if m.remoteWifiPowerSaveEnabled && m.remoteWifiControlTopic != "" && m.updateInterval > time.Minute && m.powerSaveWifiOn {
-			// Check if a command was recently sent - keep WiFi on to receive status update
-			timeSinceCommand := time.Since(m.lastCommandTime)
-			if !m.lastCommandTime.IsZero() && timeSinceCommand < m.remoteWifiCommandWait {
-				remaining := m.remoteWifiCommandWait - timeSinceCommand
-				log.Infof("[Power Save] Command recently sent, keeping WiFi on for %v to receive status update", remaining)
-				time.Sleep(remaining)
-				log.Infof("[Power Save] Command wait period complete")
-			}
-			log.Infof("[Power Save] Connection cycle complete - turning WiFi off")
-			m.remoteWifiDisable()
-			m.powerSaveWifiOn = false
+// powerSaveWifiOff turns WiFi off after a connection cycle in power
+// save mode.
+func (m *mqttClient) powerSaveWifiOff() {
+	if m.remoteWifiPowerSaveEnabled && m.remoteWifiControlTopic != "" && m.updateInterval > time.Minute && m.powerSaveWifiOn {
+		// Check if a command was recently sent - keep WiFi on to receive status update
+		timeSinceCommand := time.Since(m.lastCommandTime)
+		if !m.lastCommandTime.IsZero() && timeSinceCommand < m.remoteWifiCommandWait {
+			remaining := m.remoteWifiCommandWait - timeSinceCommand
+			log.Infof("[Power Save] Command recently sent, keeping WiFi on for %v to receive status update", remaining)
+			time.Sleep(remaining)
+			log.Infof("[Power Save] Command wait period complete")
 		}
-	}()
+		log.Infof("[Power Save] Connection cycle complete - turning WiFi off")
+		m.remoteWifiDisable()
+		m.powerSaveWifiOn = false
+	}
+}
 
-	var err error
+// newPhevClient creates the client for each connection attempt, with
+// the current configuration.
+func (m *mqttClient) newPhevClient() (*client.Client, error) {
 	address := viper.GetString("address")
 	log.Debugf("Creating new PHEV client for address: %s", address)
-	m.phev, err = client.New(
+	phev, err := client.New(
 		client.AddressOption(address),
 		client.TCPReadTimeoutOption(m.phevTCPReadTimeout),
 		client.TCPWriteTimeoutOption(m.phevTCPWriteTimeout),
 		client.StartTimeoutOption(m.phevStartTimeout),
 		client.RegisterTimeoutOption(m.phevRegisterTimeout),
+		client.TimeSyncOption(m.phevTimeSyncThreshold),
+		client.StateOption(m.state),
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create PHEV client: %w", err)
+		return nil, fmt.Errorf("failed to create PHEV client: %w", err)
 	}
+	m.phev = phev
+	return phev, nil
+}
 
-	log.Infof("Attempting to connect to PHEV at %s...", address)
-	if err := m.phev.Connect(); err != nil {
-		return fmt.Errorf("failed to connect to PHEV: %w", err)
-	}
-	log.Infof("Successfully connected to PHEV")
+// handlePhev runs a connection to the PHEV once it has started,
+// publishing its updates until it closes.
+func (m *mqttClient) handlePhev(ctx context.Context, phev *client.Client) error {
+	defer func() {
+		m.setConnected(false)
+		m.lastConnect = time.Now()
+	}()
 
-	log.Debugf("Starting PHEV client...")
-	if err := m.phev.Start(); err != nil {
-		return fmt.Errorf("failed to start PHEV client: %w", err)
-	}
 	log.Infof("PHEV client started successfully")
 	m.client.Publish(m.topic("/available"), 0, true, "online")
 	log.Infof("Published availability status: online")
 	m.setConnected(true)
 
 	// Request an immediate update so HA entities get state before any power-save disconnect.
-	if err := m.phev.SetRegister(0x6, []byte{0x3}); err != nil {
+	if err := m.vehicle().RequestUpdate(m.ctx); err != nil {
 		log.Infof("Error requesting initial update: %v", err)
 	} else {
 		m.lastUpdateTime = time.Now()
@@ -1407,9 +1464,6 @@ func (m *mqttClient) handlePhev(cmd *cobra.Command) error {
 
 	m.lastError = nil
 
-	var encodingErrorCount = 0
-	var lastEncodingError time.Time
-
 	updaterTicker := time.NewTicker(m.updateInterval)
 
 	// In power save mode, set up a connection duration timer
@@ -1422,6 +1476,9 @@ func (m *mqttClient) handlePhev(cmd *cobra.Command) error {
 
 	for {
 		select {
+		case <-ctx.Done():
+			updaterTicker.Stop()
+			return ctx.Err()
 		case <-updaterTicker.C:
 			// Power save mode: only turn on WiFi if NOT already managed by main loop
 			if m.remoteWifiPowerSaveEnabled && m.remoteWifiControlTopic != "" && m.updateInterval > time.Minute && !m.powerSaveWifiOn {
@@ -1431,8 +1488,9 @@ func (m *mqttClient) handlePhev(cmd *cobra.Command) error {
 				time.Sleep(m.remoteWifiPowerSaveWait)
 				m.powerSaveWifiOn = true
 			}
-			m.phev.SetRegister(0x6, []byte{0x3})
+			m.vehicle().RequestUpdate(m.ctx)
 			m.lastUpdateTime = time.Now()
+			m.publishHealth()
 		case <-func() <-chan time.Time {
 			if powerSaveTimer != nil {
 				return powerSaveTimer.C
@@ -1442,32 +1500,21 @@ func (m *mqttClient) handlePhev(cmd *cobra.Command) error {
 			// Power save timer expired - disconnect to turn WiFi off
 			log.Infof("[Power Save] Connection duration reached, disconnecting to turn WiFi off")
 			updaterTicker.Stop()
-			m.phev.Close()
 			return nil
-		case msg, ok := <-m.phev.Recv:
+		case msg, ok := <-phev.Recv:
 			if !ok {
 				log.Infof("Connection closed.")
 				updaterTicker.Stop()
-				return fmt.Errorf("Connection closed.")
+				return client.ErrClosed
 			}
+			m.publish("/protocol/errors", fmt.Sprintf("%d", phev.Health().Errors()))
 			switch msg.Type {
-			case protocol.CmdInBadEncoding:
-				if time.Now().Sub(lastEncodingError) > m.encodingErrorResetInterval {
-					encodingErrorCount = 0
-				}
-				if encodingErrorCount > 50 {
-					m.phev.Close()
-					updaterTicker.Stop()
-					return fmt.Errorf("Disconnecting due to too many errors")
-				}
-				encodingErrorCount += 1
-				lastEncodingError = time.Now()
 			case protocol.CmdInResp:
 				if msg.Ack != protocol.Request {
 					break
 				}
 				m.publishRegister(msg)
-				m.phev.Send <- &protocol.PhevMessage{
+				phev.Send <- &protocol.PhevMessage{
 					Type:     protocol.CmdOutSend,
 					Register: msg.Register,
 					Ack:      protocol.Ack,
@@ -1502,10 +1549,12 @@ func (m *mqttClient) publishRegister(msg *protocol.PhevMessage) {
 		m.publish("/battery/warning", fmt.Sprintf("%d", reg.Warning))
 	case *protocol.RegisterACOperStatus:
 		m.publish("/climate/operating", boolOnOff[reg.Operating])
+		m.publish("/ignition", reg.Ignition.String())
 	case *protocol.RegisterWIFISSID:
 		m.publish("/wifi/ssid", reg.SSID)
 	case *protocol.RegisterTime:
 		m.publish("/time", reg.Time.Format(time.RFC3339))
+		m.publish("/time/drift", fmt.Sprintf("%d", int64(reg.Drift(time.Now()).Seconds())))
 	case *protocol.RegisterSettings:
 		m.publish("/settings", reg.Raw())
 	case *protocol.RegisterACMode:
@@ -1520,14 +1569,9 @@ func (m *mqttClient) publishRegister(msg *protocol.PhevMessage) {
 		}
 	case *protocol.RegisterChargeStatus:
 		m.publish("/charge/charging", boolOnOff[reg.Charging])
-		if reg.Remaining < 1000 {
-			m.publish("/charge/remaining", fmt.Sprintf("%d", reg.Remaining))
-		} else {
-			log.Debugf("Ignoring charge remanining reading: %v", reg.Remaining)
-			if cache := m.mqttData["/charge/remaining"]; cache != "" {
-				m.publish("/charge/remaining", cache)
-				log.Debugf("Publishing last best known charge remaining reading: %v", cache)
-			}
+		// The state skips implausible readings, keeping the last good one.
+		if v, ok := m.state.Get(client.FieldChargeRemaining); ok {
+			m.publish("/charge/remaining", fmt.Sprintf("%d", v.Value))
 		}
 	case *protocol.RegisterDoorStatus:
 		m.publish("/door/locked", boolOpen[!reg.Locked])
@@ -1541,13 +1585,8 @@ func (m *mqttClient) publishRegister(msg *protocol.PhevMessage) {
 		m.publish("/door/boot", boolOpen[reg.Boot])
 		m.publish("/lights/head", boolOnOff[reg.Headlights])
 	case *protocol.RegisterBatteryLevel:
-		if (reg.Level > 5) && (reg.Level < 255) {
-			m.publish("/battery/level", fmt.Sprintf("%d", reg.Level))
-		} else {
-			if cache := m.mqttData["/battery/level"]; cache != "" {
-				m.publish("/battery/level", cache)
-				log.Debugf("Ignoring battery level reading: %v, publishing last best known: %v", reg.Level, cache)
-			}
+		if v, ok := m.state.Get(client.FieldBatteryLevel); ok {
+			m.publish("/battery/level", fmt.Sprintf("%d", v.Value))
 		}
 		m.publish("/lights/parking", boolOnOff[reg.ParkingLights])
 	case *protocol.RegisterLightStatus:
@@ -1559,6 +1598,10 @@ func (m *mqttClient) publishRegister(msg *protocol.PhevMessage) {
 		} else {
 			m.publish("/charge/plug", "unplugged")
 		}
+	case *protocol.RegisterDefined:
+		for _, f := range reg.Fields {
+			m.publish(fmt.Sprintf("/%s/%s", reg.Definition.TopicName(), f.Name), f.String())
+		}
 	}
 }
 
@@ -1778,6 +1821,18 @@ func (m *mqttClient) publishHomeAssistantDiscovery(vin, topic, name string) {
 			"model": "Outlander PHEV"
 		},
 		"~": "__TOPIC__"}`,
+		"%s/sensor/%s_ignition/config": `{
+		"name": "__NAME__ Ignition",
+		"icon": "mdi:car-key",
+		"state_topic": "~/ignition",
+		"unique_id": "__VIN___ignition",
+		"dev": {
+			"name": "PHEV __VIN__",
+			"identifiers": ["phev-__VIN__"],
+			"manufacturer": "Mitsubishi",
+			"model": "Outlander PHEV"
+		},
+		"~": "__TOPIC__"}`,
 		"%s/switch/%s_climate_heat/config": `{
 		"name": "__NAME__ Heat",
 		"icon": "mdi:weather-sunny",
@@ -1952,6 +2007,35 @@ func (m *mqttClient) publishHomeAssistantDiscovery(vin, topic, name string) {
 			"model": "Outlander PHEV"
 		},
 		"~": "__TOPIC__"}`,
+		"%s/sensor/%s_protocol_errors/config": `{
+		"name": "__NAME__ Protocol Errors",
+		"state_topic": "~/protocol/errors",
+		"icon": "mdi:alert-circle-outline",
+		"entity_category": "diagnostic",
+		"state_class": "total_increasing",
+		"unique_id": "__VIN___protocol_errors",
+		"dev": {
+			"name": "PHEV __VIN__",
+			"identifiers": ["phev-__VIN__"],
+			"manufacturer": "Mitsubishi",
+			"model": "Outlander PHEV"
+		},
+		"~": "__TOPIC__"}`,
+		"%s/sensor/%s_time_drift/config": `{
+		"name": "__NAME__ Clock Drift",
+		"state_topic": "~/time/drift",
+		"icon": "mdi:clock-alert-outline",
+		"entity_category": "diagnostic",
+		"device_class": "duration",
+		"unit_of_measurement": "s",
+		"unique_id": "__VIN___time_drift",
+		"dev": {
+			"name": "PHEV __VIN__",
+			"identifiers": ["phev-__VIN__"],
+			"manufacturer": "Mitsubishi",
+			"model": "Outlander PHEV"
+		},
+		"~": "__TOPIC__"}`,
 		"%s/sensor/%s_ecu_version/config": `{
 		"name": "__NAME__ ECU Version",
 		"state_topic": "~/ecuversion",
@@ -2051,7 +2135,7 @@ func init() {
 	mqttCmd.Flags().Duration("remote_wifi_command_wait", 10*time.Second, "Time to keep WiFi on after sending a command to receive status updates")
 
 	// Advanced timeout settings
-	mqttCmd.Flags().Duration("connection_retry_interval", 60*time.Second, "Time to wait between connection retry attempts")
+	mqttCmd.Flags().Duration("connection_retry_interval", 60*time.Second, "Maximum time to wait between connection retry attempts, which back off from 5s")
 	mqttCmd.Flags().Duration("availability_offline_timeout", 30*time.Second, "Time without connection before publishing MQTT offline status")
 	mqttCmd.Flags().Duration("remote_wifi_restart_min_interval", 2*time.Minute, "Minimum time between remote WiFi restart attempts")
 	mqttCmd.Flags().Duration("phev_start_timeout", 20*time.Second, "Timeout waiting for PHEV to respond to start command")
@@ -2060,6 +2144,7 @@ func init() {
 	mqttCmd.Flags().Duration("phev_tcp_write_timeout", 15*time.Second, "TCP write deadline for PHEV connection")
 	mqttCmd.Flags().Duration("encoding_error_reset_interval", 15*time.Second, "Time after which encoding error count resets")
 	mqttCmd.Flags().Duration("config_reload_interval", 5*time.Second, "How often to check for configuration file changes")
+	mqttCmd.Flags().Duration("phev_time_sync_threshold", 0, "Set the car clock on connect if it drifts more than this from local time (0 to disable)")
 
 	viper.BindPFlag("mqtt_server", mqttCmd.Flags().Lookup("mqtt_server"))
 	viper.BindPFlag("mqtt_username", mqttCmd.Flags().Lookup("mqtt_username"))
@@ -2092,4 +2177,5 @@ func init() {
 	viper.BindPFlag("phev_tcp_write_timeout", mqttCmd.Flags().Lookup("phev_tcp_write_timeout"))
 	viper.BindPFlag("encoding_error_reset_interval", mqttCmd.Flags().Lookup("encoding_error_reset_interval"))
 	viper.BindPFlag("config_reload_interval", mqttCmd.Flags().Lookup("config_reload_interval"))
+	viper.BindPFlag("phev_time_sync_threshold", mqttCmd.Flags().Lookup("phev_time_sync_threshold"))
 }
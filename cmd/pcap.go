@@ -71,13 +71,17 @@ via Android (https://wladimir-tm4pda.github.io/porting/tcpdump.html)
 			log.Fatal(err)
 		}
 		defer handle.Close()
-		securityKey = &protocol.SecurityKey{}
+		securityKey = &protocol.SecurityKey{Logger: log.StandardLogger()}
 		pings, _ = cmd.Flags().GetBool("pings")
 
 		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+		packets := packetSource.Packets()
+		if r, _ := cmd.Flags().GetBool("recover-key"); r {
+			packets = recoverKey(cmd, packets)
+		}
 		var currentTime time.Time
 		pNum := 0
-		for packet := range packetSource.Packets() {
+		for packet := range packets {
 			if m := packet.Metadata(); m != nil {
 				if pNum > 0 {
 					if r, _ := cmd.Flags().GetBool("latency"); r {
@@ -91,9 +95,30 @@ via Android (https://wladimir-tm4pda.github.io/porting/tcpdump.html)
 			pNum += 1
 			decodePacket(cmd, packet)
 		}
+		logDecodeHealth()
 	},
 }
 
+// recoverKey reads all packets to recover the security key, returning
+// them to be decoded with it.
+func recoverKey(cmd *cobra.Command, packets chan gopacket.Packet) chan gopacket.Packet {
+	all := []gopacket.Packet{}
+	data := []byte{}
+	for packet := range packets {
+		all = append(all, packet)
+		if al := packet.ApplicationLayer(); al != nil {
+			data = append(data, al.Payload()...)
+		}
+	}
+	securityKey = newSecurityKey(cmd, data)
+	ret := make(chan gopacket.Packet, len(all))
+	for _, packet := range all {
+		ret <- packet
+	}
+	close(ret)
+	return ret
+}
+
 func decodePacket(cmd *cobra.Command, packet gopacket.Packet) {
 	dir := "?"
 	tcpLayer := packet.Layer(layers.LayerTypeTCP)
@@ -135,7 +160,7 @@ func decodePacket(cmd *cobra.Command, packet gopacket.Packet) {
 
 func processPayload(cmd *cobra.Command, data []byte, dir string) {
 	log.Tracef("%%PHEV_PCAP_RAW_%s%%: %s\n", strings.ToUpper(dir), hex.EncodeToString(data))
-	msgs := protocol.NewFromBytes(data, securityKey)
+	msgs := decodeMessages(data)
 	for _, msg := range msgs {
 		if r, _ := cmd.Flags().GetBool("registers"); r {
 			handleRegisters(msg)
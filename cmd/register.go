@@ -17,6 +17,8 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	"github.com/buxtronix/phev2mqtt/client"
@@ -57,41 +59,23 @@ are going via a NAT gateway, etc, then bear this in mind.
 }
 
 func runRegister(cmd *cobra.Command, args []string) {
-	var err error
+	err := newSupervisor(cmd, client.MaxAttemptsOption(5)).Run(context.Background(), func(ctx context.Context, cl *client.Client) error {
+		log.Infof("Client connected and started!")
 
-	address, _ := cmd.Flags().GetString("address")
-	cl, err := client.New(client.AddressOption(address))
-	if err != nil {
-		panic(err)
-	}
-
-	if err := cl.Connect(); err != nil {
-		panic(err)
-	}
+		vinCh := make(chan string, 1)
 
-	if err := cl.Start(); err != nil {
-		panic(err)
-	}
-	log.Infof("Client connected and started!")
-
-	vinCh := make(chan string)
-
-	go func() {
-		for {
-			select {
-			case msg, ok := <-cl.Recv:
-				if !ok {
-					log.Errorf("Connection closed.")
-					close(vinCh)
-					return
-				}
+		go func() {
+			for msg := range cl.Recv {
 				switch msg.Type {
 				case protocol.CmdInResp:
 					if msg.Ack != protocol.Request {
 						break
 					}
 					if reg, ok := msg.Reg.(*protocol.RegisterVIN); ok {
-						vinCh <- reg.VIN
+						select {
+						case vinCh <- reg.VIN:
+						default:
+						}
 					}
 					cl.Send <- &protocol.PhevMessage{
 						Type:     protocol.CmdOutSend,
@@ -102,28 +86,39 @@ func runRegister(cmd *cobra.Command, args []string) {
 					}
 				}
 			}
+			log.Errorf("Connection closed.")
+			close(vinCh)
+		}()
+
+		var vin string
+		select {
+		case v, ok := <-vinCh:
+			if !ok {
+				return fmt.Errorf("client closed before receiving VIN: %w", client.ErrClosed)
+			}
+			vin = v
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-	}()
 
-	vin, ok := <-vinCh
-	if !ok {
-		log.Errorf("Client closed before recieving VIN")
-		return
-	}
-
-	reg := byte(0x10)
-	if cmd.Use == "unregister" {
-		log.Infof("Attempting to unregister from car (VIN: %s)...", vin)
-		reg = 0x15
-	} else {
-		log.Infof("Attempting to register to car (VIN: %s)...", vin)
-	}
-	if err := cl.SetRegister(reg, []byte{0x1}); err != nil {
-		log.Errorf("Failed to (un)register: %v", err)
-		return
+		v := client.NewVehicle(cl)
+		var err error
+		if cmd.Use == "unregister" {
+			log.Infof("Attempting to unregister from car (VIN: %s)...", vin)
+			err = v.Unregister(ctx)
+		} else {
+			log.Infof("Attempting to register to car (VIN: %s)...", vin)
+			err = v.Register(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to (un)register: %w", err)
+		}
+		time.Sleep(time.Second)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
-	cl.Close()
-	time.Sleep(time.Second)
 	log.Infof("Success!")
 }
 
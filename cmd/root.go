@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/buxtronix/phev2mqtt/protocol"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -112,6 +113,14 @@ var rootCmd = &cobra.Command{
 				DisableTimestamp: true,
 			})
 		}
+		if defs := viper.GetString("register_definitions"); defs != "" {
+			loaded, err := protocol.LoadDefinitionFile(defs)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load register definitions: %v\n", err)
+				os.Exit(1)
+			}
+			log.Infof("Loaded %d register definitions from %s", len(loaded), defs)
+		}
 	},
 
 	// Uncomment the following line if your bare application
@@ -137,7 +146,10 @@ func init() {
 	rootCmd.PersistentFlags().BoolVarP(&logTimes, "log_timestamps", "t", false, "coloured logging with timestamps")
 	rootCmd.PersistentFlags().BoolVarP(&logSyslog, "log_syslog", "s", false, "plain logging to syslog instead of console")
 
+	rootCmd.PersistentFlags().String("register_definitions", "", "YAML or JSON file defining register fields to decode")
+
 	viper.BindPFlag("log_timestamps", rootCmd.PersistentFlags().Lookup("log_timestamps"))
+	viper.BindPFlag("register_definitions", rootCmd.PersistentFlags().Lookup("register_definitions"))
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -167,6 +179,7 @@ func initConfig() {
 	}
 	viper.AutomaticEnv()           // read in environment variables that match
 	viper.BindEnv("log_timestamps", "log_timestamps", "LOG_TIMESTAMPS")
+	viper.BindEnv("register_definitions", "register_definitions", "REGISTER_DEFINITIONS")
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
@@ -17,6 +17,7 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
 	"encoding/hex"
 	"strings"
 	"time"
@@ -80,32 +81,29 @@ func runSet(cmd *cobra.Command, args []string) {
 		panic(err)
 	}
 
-	address, _ := cmd.Flags().GetString("address")
-	cl, err := client.New(client.AddressOption(address))
-	if err != nil {
-		panic(err)
-	}
-
-	if err := cl.Connect(); err != nil {
-		panic(err)
-	}
-
-	if err := cl.Start(); err != nil {
-		panic(err)
-	}
-	log.Infof("Client connected and started!")
-	log.Infof("Waiting %d", waitTime.String())
-
-	time.Sleep(waitTime)
+	err = newSupervisor(cmd, client.MaxAttemptsOption(5)).Run(context.Background(), func(ctx context.Context, cl *client.Client) error {
+		log.Infof("Client connected and started!")
+		log.Infof("Waiting %s", waitTime.String())
+		select {
+		case <-time.After(waitTime):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 
-	for _, reg := range setRegisters {
-		log.Infof("Setting register 0x%x to 0x%s", reg.register, hex.EncodeToString(reg.value))
-		if err := cl.SetRegister(reg.register, reg.value); err != nil {
-			panic(err)
+		for _, reg := range setRegisters {
+			log.Infof("Setting register 0x%x to 0x%s", reg.register, hex.EncodeToString(reg.value))
+			r := cl.SetRegisterResult(ctx, reg.register, reg.value)
+			if r.Err != nil {
+				return r.Err
+			}
+			log.Infof("Set %s", r)
+			time.Sleep(sendInterval)
 		}
-		time.Sleep(sendInterval)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
-
 }
 
 func init() {
@@ -17,7 +17,7 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
-	"encoding/hex"
+	"context"
 	"time"
 
 	"github.com/buxtronix/phev2mqtt/client"
@@ -36,48 +36,46 @@ updates, displaying them in real-time.`,
 }
 
 func Run(cmd *cobra.Command, args []string) {
-	address, _ := cmd.Flags().GetString("address")
-	cl, err := client.New(client.AddressOption(address))
-	if err != nil {
-		panic(err)
-	}
-
-	if err := cl.Connect(); err != nil {
-		panic(err)
-	}
-
-	if err := cl.Start(); err != nil {
-		panic(err)
-	}
-
-	var registers = map[byte]string{}
-
-	for {
-		select {
-		case m, ok := <-cl.Recv:
-			if !ok {
-				log.Infof("Connection closed.")
-				return
+	// The state is kept across connections, so only changes are logged
+	// after reconnecting.
+	state := client.NewState()
+	changes := state.Subscribe()
+	go func() {
+		for c := range changes.C {
+			if c.Old == nil {
+				c.Old = ""
 			}
-			switch m.Type {
-			case protocol.CmdInResp:
-				dataStr := hex.EncodeToString(m.Data)
-				if data := registers[m.Register]; data != dataStr {
-					log.Infof("%%PHEV_REG_UPDATE%% %02x: %s -> %s", m.Register, data, dataStr)
-					registers[m.Register] = dataStr
-					if _, ok := m.Reg.(*protocol.RegisterGeneric); !ok {
-						log.Infof("%%PHEV_REG_UPDATE%% %02x: [%s]", m.Register, m.Reg.String())
-					}
+			log.Infof("%%PHEV_STATE_UPDATE%% %s: %v -> %v", c.Field, c.Old, c.New)
+		}
+	}()
+
+	address, _ := cmd.Flags().GetString("address")
+	sup := newSupervisor(cmd, client.ClientOptions(client.AddressOption(address), client.StateOption(state)))
+	err := sup.Run(context.Background(), func(ctx context.Context, cl *client.Client) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case m, ok := <-cl.Recv:
+				if !ok {
+					log.Infof("Connection closed.")
+					return client.ErrClosed
 				}
-				cl.Send <- &protocol.PhevMessage{
-					Type:     protocol.CmdOutSend,
-					Register: m.Register,
-					Ack:      protocol.Ack,
-					Xor:      m.Xor,
-					Data:     []byte{0x0},
+				switch m.Type {
+				case protocol.CmdInResp:
+					cl.Send <- &protocol.PhevMessage{
+						Type:     protocol.CmdOutSend,
+						Register: m.Register,
+						Ack:      protocol.Ack,
+						Xor:      m.Xor,
+						Data:     []byte{0x0},
+					}
 				}
 			}
 		}
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -21,8 +21,22 @@ type Car struct {
 	Settings    *protocol.Settings
 	address     string
 	connections []*Connection
+	onWrite     func(m *protocol.PhevMessage) WriteResponse
+	modelYear   protocol.ModelYear
 }
 
+// A WriteResponse is how the car responds to a register write.
+type WriteResponse int
+
+const (
+	// WriteAck acknowledges the write.
+	WriteAck WriteResponse = iota
+	// WriteIgnore neither acknowledges nor applies the write.
+	WriteIgnore
+	// WriteBadEncoding replies that the write was badly encoded.
+	WriteBadEncoding
+)
+
 // Begin starts the emulator.
 func (c *Car) Begin() error {
 	l, err := net.Listen("tcp4", c.address)
@@ -36,7 +50,7 @@ func (c *Car) Begin() error {
 		for {
 			conn, err := l.Accept()
 			if err != nil {
-				log.Errorf("Accept() error: %v")
+				log.Errorf("Accept() error: %v", err)
 				return
 			}
 			svc := NewConnection(conn, c)
@@ -90,11 +104,42 @@ func AddressOption(address string) func(*Car) {
 	}
 }
 
+// WriteHandlerOption sets a function called with each register write
+// from a client, returning how the car responds. It is called from the
+// connection's manager, so a delay in it delays the response. By
+// default every write is acknowledged.
+func WriteHandlerOption(f func(m *protocol.PhevMessage) WriteResponse) func(*Car) {
+	return func(c *Car) {
+		c.onWrite = f
+	}
+}
+
+// ModelYearOption sets the model year the car announces in its start
+// request. The default is MY'18.
+func ModelYearOption(year protocol.ModelYear) func(*Car) {
+	return func(c *Car) {
+		c.modelYear = year
+	}
+}
+
+// startRequest returns the start request message type for the car's
+// model year.
+func (c *Car) startRequest() byte {
+	switch c.modelYear {
+	case protocol.ModelYear14:
+		return protocol.CmdInMy14StartReq
+	case protocol.ModelYear24:
+		return protocol.CmdInMy24StartReq
+	}
+	return protocol.CmdInMy18StartReq
+}
+
 // NewCar returns a new Car. You get a Car! Everyone gets a Car!
 func NewCar(opts ...Option) (*Car, error) {
 	c := &Car{
-		Registers: defaultRegisters,
+		Registers: append([]protocol.Register{}, defaultRegisters...),
 		Settings:  &protocol.Settings{},
+		modelYear: protocol.ModelYear18,
 	}
 	for _, o := range opts {
 		o(c)
@@ -127,7 +172,7 @@ var defaultRegisters = []protocol.Register{
 	mustRegister(0x0c, "01"),
 	mustRegister(0x0d, "04"),
 	mustRegister(0x0f, "00"),
-	mustRegister(0x10, "000000"),
+	&protocol.RegisterPreACState{State: protocol.PreACOff},
 	mustRegister(0x11, "00"),
 	mustRegister(0x12, "160a0712391805"),
 	mustRegister(0x13, "00"),
@@ -143,7 +188,7 @@ var defaultRegisters = []protocol.Register{
 	mustRegister(0x1f, "00ffff"),
 	mustRegister(0x21, "00"),
 	mustRegister(0x22, "000000000000"),
-	mustRegister(0x23, "0000000202"),
+	&protocol.RegisterLightStatus{},
 	mustRegister(0x24, "02000000000000000000"),
 	mustRegister(0x25, "0e00ff"),
 	mustRegister(0x26, "00"),
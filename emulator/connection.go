@@ -27,7 +27,7 @@ func NewConnection(conn net.Conn, car *Car) *Connection {
 		state: conClosed,
 		car:   car,
 		conn:  conn,
-		key:   &protocol.SecurityKey{},
+		key:   &protocol.SecurityKey{Logger: log.StandardLogger()},
 		Send:  make(chan *protocol.PhevMessage, 5),
 
 		listeners: []*client.Listener{},
@@ -48,6 +48,8 @@ type Connection struct {
 
 	registerIndex  int
 	settingsSender *protocol.SettingsSender
+	// Setting written to 0x0f, applied when saved via 0x0e.
+	pendingSetting []byte
 }
 
 func (s *Connection) Close() error {
@@ -88,27 +90,27 @@ func (s *Connection) Start() {
 }
 
 func (s *Connection) reader() {
+	dec := protocol.NewDecoder(s.conn, s.key)
+	dec.OnResync = func(e protocol.ResyncEvent) {
+		log.Debugf("%%PHEV_SVC_RESYNC%% %s", e)
+	}
 	for {
-		s.conn.(*net.TCPConn).SetReadDeadline(time.Now().Add(30 * time.Second))
-		data := make([]byte, 4096)
-		n, err := s.conn.Read(data)
+		s.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		m, err := dec.Decode()
 		if err != nil {
 			log.Debugf("%%PHEV_SVC_READER_ERROR%% %v", err)
 			s.conn.Close()
 			return
 		}
-		log.Tracef("%%PHEV_SVC_RECV_RAW%%: %s", hex.EncodeToString(data[:n]))
-		msgs := protocol.NewFromBytes(data[:n], s.key)
-		for _, m := range msgs {
-			if m.Type != protocol.CmdOutPingReq {
-				log.Debugf("%%PHEV_SVC_RCV_MSG%%: %s", m.ShortForm())
-			}
-			s.lMu.Lock()
-			for _, l := range s.listeners {
-				l.Send(m)
-			}
-			s.lMu.Unlock()
+		log.Tracef("%%PHEV_SVC_RECV_RAW%%: %s", hex.EncodeToString(m.OriginalXored))
+		if m.Type != protocol.CmdOutPingReq {
+			log.Debugf("%%PHEV_SVC_RCV_MSG%%: %s", m.ShortForm())
+		}
+		s.lMu.Lock()
+		for _, l := range s.listeners {
+			l.Send(m)
 		}
+		s.lMu.Unlock()
 	}
 }
 
@@ -125,7 +127,7 @@ func (s *Connection) writer() {
 				log.Debugf("%%PHEV_SVC_SND_MSG%%: %s", msg.ShortForm())
 			}
 			data := msg.EncodeToBytes(s.key)
-			s.conn.(*net.TCPConn).SetWriteDeadline(time.Now().Add(15 * time.Second))
+			s.conn.SetWriteDeadline(time.Now().Add(15 * time.Second))
 			if _, err := s.conn.Write(data); err != nil {
 				log.Debugf("%%PHEV_SVC_WRITE_ERR%%: %v", err)
 				s.Close()
@@ -1,6 +1,7 @@
 package emulator
 
 import (
+	"encoding/hex"
 	"github.com/buxtronix/phev2mqtt/protocol"
 	log "github.com/sirupsen/logrus"
 	"time"
@@ -26,7 +27,7 @@ func (s *Connection) manage() {
 					s.state = conSecInit
 					s.rekey()
 				}
-			case protocol.CmdOutMy18StartResp:
+			case protocol.CmdOutMy18StartResp, protocol.CmdOutMy14StartResp, protocol.CmdOutMy24StartResp:
 				if msg.Original[2] == 0x0 {
 					s.rekey()
 					break
@@ -64,6 +65,15 @@ func (s *Connection) getRegister(r byte) protocol.Register {
 }
 
 func (s *Connection) handleSetRegister(msg *protocol.PhevMessage) {
+	if s.car.onWrite != nil {
+		switch s.car.onWrite(msg) {
+		case WriteIgnore:
+			return
+		case WriteBadEncoding:
+			s.Send <- protocol.NewMessage(protocol.CmdInBadEncoding, msg.Register, false, []byte{s.key.SKey(false)})
+			return
+		}
+	}
 	// Ack the message that came in.
 	s.Send <- protocol.NewMessage(protocol.CmdInResp, msg.Register, true, []byte{0x0})
 	switch msg.Register {
@@ -71,6 +81,25 @@ func (s *Connection) handleSetRegister(msg *protocol.PhevMessage) {
 		s.Send <- protocol.NewMessage(protocol.CmdInResp, protocol.TimeRegister, false, msg.Data)
 		time.Sleep(20 * time.Millisecond)
 		s.Send <- protocol.NewMessage(protocol.CmdInResp, protocol.BatteryLevelRegister, false, []byte{0x50, 0x00, 0x00, 0x00})
+	case protocol.UpdateSettingsRegister:
+		if len(msg.Data) != 2 {
+			log.Errorf("Bad settings update: %s", hex.EncodeToString(msg.Data))
+			return
+		}
+		s.pendingSetting = msg.Data
+	case protocol.SaveSettingsRegister:
+		if s.pendingSetting == nil {
+			return
+		}
+		id, value := protocol.SettingID(s.pendingSetting[0]), int(s.pendingSetting[1])
+		s.pendingSetting = nil
+		reg, err := s.car.Settings.Set(id, value)
+		if err != nil {
+			log.Errorf("Error saving setting: %v", err)
+			return
+		}
+		log.Infof("Saved setting %s", protocol.Setting{ID: id, Value: value})
+		s.Send <- protocol.NewMessage(protocol.CmdInResp, protocol.SettingsRegister, false, reg)
 	}
 
 }
@@ -104,9 +133,9 @@ func (s *Connection) sendNextRegister() {
 // Generate and send new key request.
 func (s *Connection) rekey() {
 	if s.state == conRegisterStart {
-		s.Send <- protocol.NewMessage(protocol.CmdInMy18StartReq, 0x1, true, []byte{0x0})
+		s.Send <- protocol.NewMessage(s.car.startRequest(), 0x1, true, []byte{0x0})
 	}
 	data := s.key.GenerateProposal()
-	s.Send <- protocol.NewMessage(protocol.CmdInMy18StartReq, 0x1, false, append(data, 0x1))
+	s.Send <- protocol.NewMessage(s.car.startRequest(), 0x1, false, append(data, 0x1))
 	s.key.State = protocol.SecurityKeyProposed
 }
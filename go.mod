@@ -11,6 +11,7 @@ require (
 	github.com/wercker/journalhook v0.0.0-20230927020745-64542ffa4117
 	golang.org/x/sync v0.17.0
 	gopkg.in/d4l3k/messagediff.v1 v1.2.1
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -32,5 +33,4 @@ require (
 	golang.org/x/sys v0.36.0 // indirect
 	golang.org/x/text v0.29.0 // indirect
 	gopkg.in/ini.v1 v1.62.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
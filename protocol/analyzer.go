@@ -0,0 +1,249 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A BitChange is a single register bit changing value between two
+// notifications of the register.
+type BitChange struct {
+	Time     time.Time
+	Register byte
+	// Byte and Bit locate the bit, bit 0 being the least significant.
+	Byte, Bit int
+	// To is the new value of the bit.
+	To bool
+}
+
+func (c BitChange) String() string {
+	from, to := 0, 1
+	if !c.To {
+		from, to = 1, 0
+	}
+	return fmt.Sprintf("0x%02x byte %d bit %d %d->%d", c.Register, c.Byte, c.Bit, from, to)
+}
+
+// An Event marks something done to the car, such as opening a door,
+// to line up with register changes around the same time.
+type Event struct {
+	Time  time.Time
+	Label string
+}
+
+// Time formats accepted for an event. Those without a date take it
+// from the reference time given to ParseEvent.
+var eventTimeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"15:04:05.000",
+	"15:04:05",
+}
+
+// ParseEvent parses an event from "<time> <label>", such as
+// "12:01:03 opened driver door". A time of day is taken to be on the
+// same day as ref.
+func ParseEvent(s string, ref time.Time) (Event, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), " ", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return Event{}, fmt.Errorf("event must be \"<time> <label>\": %q", s)
+	}
+	for _, f := range eventTimeFormats {
+		t, err := time.ParseInLocation(f, parts[0], ref.Location())
+		if err != nil {
+			continue
+		}
+		if t.Year() == 0 {
+			t = time.Date(ref.Year(), ref.Month(), ref.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), ref.Location())
+		}
+		return Event{Time: t, Label: strings.TrimSpace(parts[1])}, nil
+	}
+	return Event{}, fmt.Errorf("invalid event time %q", parts[0])
+}
+
+// An Analyzer tracks register notifications bit by bit, recording each
+// bit that changes. It is an aid to reverse engineering registers that
+// are not yet understood.
+type Analyzer struct {
+	// Window is how far either side of an event a change is reported
+	// as related to it.
+	Window time.Duration
+
+	last    map[byte][]byte
+	first   time.Time
+	changes []BitChange
+	events  []Event
+}
+
+// NewAnalyzer returns an Analyzer relating changes within 5 seconds of
+// an event.
+func NewAnalyzer() *Analyzer {
+	return &Analyzer{
+		Window: 5 * time.Second,
+		last:   map[byte][]byte{},
+	}
+}
+
+// Add records a message received at time t, returning any bits changed
+// since the register was last seen. Only register notifications are
+// analyzed. The first notification of a register sets its baseline. If
+// the length changes, missing bytes are taken as zero.
+func (a *Analyzer) Add(m *PhevMessage, t time.Time) []BitChange {
+	if m.Type != CmdInResp || m.Ack != Request {
+		return nil
+	}
+	if a.first.IsZero() {
+		a.first = t
+	}
+	last, ok := a.last[m.Register]
+	a.last[m.Register] = append([]byte{}, m.Data...)
+	if !ok {
+		return nil
+	}
+	var changes []BitChange
+	for i := 0; i < len(last) || i < len(m.Data); i++ {
+		var old, cur byte
+		if i < len(last) {
+			old = last[i]
+		}
+		if i < len(m.Data) {
+			cur = m.Data[i]
+		}
+		for bit := 0; bit < 8; bit++ {
+			if (old^cur)&(1<<uint(bit)) != 0 {
+				changes = append(changes, BitChange{
+					Time:     t,
+					Register: m.Register,
+					Byte:     i,
+					Bit:      bit,
+					To:       cur&(1<<uint(bit)) != 0,
+				})
+			}
+		}
+	}
+	a.changes = append(a.changes, changes...)
+	return changes
+}
+
+// AddEvent adds an event marker.
+func (a *Analyzer) AddEvent(e Event) {
+	a.events = append(a.events, e)
+}
+
+// Start returns the time of the first analyzed message, or the zero
+// time if none.
+func (a *Analyzer) Start() time.Time {
+	return a.first
+}
+
+// Changes returns all bit changes recorded, in the order seen.
+func (a *Analyzer) Changes() []BitChange {
+	return a.changes
+}
+
+// Related returns the changes within Window of the event.
+func (a *Analyzer) Related(e Event) []BitChange {
+	var ret []BitChange
+	for _, c := range a.changes {
+		if d := c.Time.Sub(e.Time); d >= -a.Window && d <= a.Window {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// nearestEvent returns the event closest to t within Window.
+func (a *Analyzer) nearestEvent(t time.Time) (Event, bool) {
+	var best Event
+	found := false
+	for _, e := range a.events {
+		d := t.Sub(e.Time)
+		if d < -a.Window || d > a.Window {
+			continue
+		}
+		if !found || abs(d) < abs(t.Sub(best.Time)) {
+			best, found = e, true
+		}
+	}
+	return best, found
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+type bitKey struct {
+	register byte
+	byte     int
+	bit      int
+}
+
+// Report writes the changes per register and bit, each annotated with
+// any nearby event, followed by the changes related to each event.
+func (a *Analyzer) Report(w io.Writer) {
+	byBit := map[bitKey][]BitChange{}
+	keys := []bitKey{}
+	for _, c := range a.changes {
+		k := bitKey{c.Register, c.Byte, c.Bit}
+		if _, ok := byBit[k]; !ok {
+			keys = append(keys, k)
+		}
+		byBit[k] = append(byBit[k], c)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].register != keys[j].register {
+			return keys[i].register < keys[j].register
+		}
+		if keys[i].byte != keys[j].byte {
+			return keys[i].byte < keys[j].byte
+		}
+		return keys[i].bit < keys[j].bit
+	})
+
+	register := -1
+	for _, k := range keys {
+		if int(k.register) != register {
+			register = int(k.register)
+			fmt.Fprintf(w, "Register 0x%02x:\n", k.register)
+		}
+		changes := byBit[k]
+		fmt.Fprintf(w, "  byte %d bit %d: %d changes\n", k.byte, k.bit, len(changes))
+		for _, c := range changes {
+			to := 0
+			if c.To {
+				to = 1
+			}
+			line := fmt.Sprintf("    %s ->%d", a.formatTime(c.Time), to)
+			if e, ok := a.nearestEvent(c.Time); ok {
+				line += fmt.Sprintf("  [%s %+.1fs]", e.Label, c.Time.Sub(e.Time).Seconds())
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+
+	events := append([]Event{}, a.events...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	for _, e := range events {
+		fmt.Fprintf(w, "Event %s %s:\n", a.formatTime(e.Time), e.Label)
+		related := a.Related(e)
+		if len(related) == 0 {
+			fmt.Fprintf(w, "  no changes within %s\n", a.Window)
+		}
+		for _, c := range related {
+			fmt.Fprintf(w, "  %s (%+.1fs)\n", c, c.Time.Sub(e.Time).Seconds())
+		}
+	}
+}
+
+func (a *Analyzer) formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("15:04:05.000")
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/d4l3k/messagediff.v1"
+)
+
+func TestAnalyzer(t *testing.T) {
+	start := time.Date(2024, time.March, 9, 12, 1, 0, 0, time.UTC)
+	a := NewAnalyzer()
+	for _, m := range []struct {
+		offset   time.Duration
+		register byte
+		data     []byte
+	}{
+		{0, DoorStatusRegister, []byte{0x01, 0x00}},
+		{time.Second, 0x21, []byte{0x00}},
+		{3 * time.Second, DoorStatusRegister, []byte{0x01, 0x02}},
+		{4 * time.Second, 0x21, []byte{0x00, 0x80}},
+		{30 * time.Second, DoorStatusRegister, []byte{0x00, 0x02}},
+	} {
+		a.Add(&PhevMessage{Type: CmdInResp, Ack: Request, Register: m.register, Data: m.data}, start.Add(m.offset))
+	}
+	// Not a notification, so ignored.
+	a.Add(&PhevMessage{Type: CmdOutSend, Register: DoorStatusRegister, Data: []byte{0xff, 0xff}}, start)
+
+	want := []BitChange{
+		{Time: start.Add(3 * time.Second), Register: DoorStatusRegister, Byte: 1, Bit: 1, To: true},
+		{Time: start.Add(4 * time.Second), Register: 0x21, Byte: 1, Bit: 7, To: true},
+		{Time: start.Add(30 * time.Second), Register: DoorStatusRegister, Byte: 0, Bit: 0, To: false},
+	}
+	if diff, equal := messagediff.PrettyDiff(want, a.Changes()); !equal {
+		t.Errorf("Changes() diff=%s", diff)
+	}
+
+	e, err := ParseEvent("12:01:02 opened driver door", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := e.Time, start.Add(2*time.Second); !got.Equal(want) {
+		t.Errorf("ParseEvent() time got=%v want=%v", got, want)
+	}
+	a.AddEvent(e)
+	if diff, equal := messagediff.PrettyDiff(want[:2], a.Related(e)); !equal {
+		t.Errorf("Related() diff=%s", diff)
+	}
+
+	buf := &bytes.Buffer{}
+	a.Report(buf)
+	for _, line := range []string{
+		"Register 0x24:",
+		"  byte 1 bit 1: 1 changes",
+		"    12:01:03.000 ->1  [opened driver door +1.0s]",
+		"    12:01:30.000 ->0",
+		"Event 12:01:02.000 opened driver door:",
+		"  0x21 byte 1 bit 7 0->1 (+2.0s)",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Report() missing line %q in:\n%s", line, buf)
+		}
+	}
+}
+
+func TestParseEventInvalid(t *testing.T) {
+	for _, s := range []string{"", "12:01:02", "noon lunch"} {
+		if _, err := ParseEvent(s, time.Now()); err == nil {
+			t.Errorf("ParseEvent(%q) want error", s)
+		}
+	}
+}
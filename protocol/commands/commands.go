@@ -0,0 +1,97 @@
+// Package commands builds the messages written to the car for each
+// known command. Constructors validate their arguments, and return
+// messages ready to send, such as with client.SetRegister. Encodings
+// which vary by model year come from protocol.Profile.
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+func send(register byte, data ...byte) *protocol.PhevMessage {
+	return protocol.NewMessage(protocol.CmdOutSend, register, false, data)
+}
+
+// common builds the commands which are the same on all model years.
+var common = protocol.ProfileFor(protocol.ModelYearUnknown)
+
+// SyncTime returns the message to set the car's clock. Rooted reports
+// whether the sending device is rooted, as the app does.
+func SyncTime(t time.Time, rooted bool) (*protocol.PhevMessage, error) {
+	if t.Year() < 2000 || t.Year() > 2255 {
+		return nil, fmt.Errorf("time out of range: %v", t)
+	}
+	var root byte
+	if rooted {
+		root = 0x1
+	}
+	return send(protocol.SetTimeRegister,
+		byte(t.Year()-2000),
+		byte(t.Month()),
+		byte(t.Day()),
+		byte(t.Hour()),
+		byte(t.Minute()),
+		byte(t.Second()),
+		byte(t.Weekday()),
+		root), nil
+}
+
+// RequestUpdate returns the message asking the car to resend all
+// registers.
+func RequestUpdate() *protocol.PhevMessage {
+	return common.RequestUpdateCommand()
+}
+
+// Headlights returns the message to switch the headlights.
+func Headlights(on bool) *protocol.PhevMessage {
+	return common.HeadlightsCommand(on)
+}
+
+// ParkingLights returns the message to switch the parking lights.
+func ParkingLights(on bool) *protocol.PhevMessage {
+	return common.ParkingLightsCommand(on)
+}
+
+// RegisterClient returns the message registering this client's MAC
+// address with the car. The car must be in registration mode.
+func RegisterClient() *protocol.PhevMessage {
+	return send(protocol.SetRegisterClientRegister, 0x1)
+}
+
+// UnregisterClient returns the message removing this client's
+// registration from the car.
+func UnregisterClient() *protocol.PhevMessage {
+	return send(protocol.SetUnregisterClientRegister, 0x1)
+}
+
+// PreACReset returns the message to acknowledge a terminated
+// pre-conditioning.
+func PreACReset() *protocol.PhevMessage {
+	return common.PreACResetCommand()
+}
+
+// CancelChargeTimer returns the messages to cancel the charge timer, so
+// charging starts immediately.
+func CancelChargeTimer() []*protocol.PhevMessage {
+	return common.CancelChargeTimerCommands()
+}
+
+// Climate returns the MY'18 onwards message to set the climate mode,
+// running for the given minutes (10, 20 or 30) after a delay of 0, 5
+// or 10 minutes. The duration and delay are ignored for ClimateOff.
+func Climate(mode protocol.ClimateMode, minutes, delay int) (*protocol.PhevMessage, error) {
+	msgs, err := protocol.ProfileFor(protocol.ModelYear18).ClimateDelayCommands(mode, minutes, delay)
+	if err != nil {
+		return nil, err
+	}
+	return msgs[0], nil
+}
+
+// ClimateFor returns the messages to set the climate mode for a model
+// year, as built by its protocol.Profile.
+func ClimateFor(year protocol.ModelYear, mode protocol.ClimateMode, minutes, delay int) ([]*protocol.PhevMessage, error) {
+	return protocol.ProfileFor(year).ClimateDelayCommands(mode, minutes, delay)
+}
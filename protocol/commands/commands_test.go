@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+func msgString(m *protocol.PhevMessage) string {
+	return hex.EncodeToString([]byte{m.Register}) + ":" + hex.EncodeToString(m.Data)
+}
+
+func TestCommands(t *testing.T) {
+	syncTime, err := SyncTime(time.Date(2024, time.March, 9, 13, 45, 10, 0, time.UTC), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	climate, err := Climate(protocol.ClimateCool, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		msg  *protocol.PhevMessage
+		want string
+	}{
+		{"sync time", syncTime, "05:1803090d2d0a0601"},
+		{"request update", RequestUpdate(), "06:03"},
+		{"headlights on", Headlights(true), "0a:01"},
+		{"headlights off", Headlights(false), "0a:02"},
+		{"parking lights on", ParkingLights(true), "0b:01"},
+		{"parking lights off", ParkingLights(false), "0b:02"},
+		{"register", RegisterClient(), "10:01"},
+		{"unregister", UnregisterClient(), "15:01"},
+		{"pre-AC reset", PreACReset(), "13:01"},
+		{"cancel charge timer", CancelChargeTimer()[0], "17:01"},
+		{"cancel charge timer 2", CancelChargeTimer()[1], "17:11"},
+		{"climate delay", climate, "1b:02010002"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := msgString(test.msg); got != test.want {
+				t.Errorf("got=%s want=%s", got, test.want)
+			}
+			if test.msg.Type != protocol.CmdOutSend {
+				t.Errorf("type got=0x%02x want=0x%02x", test.msg.Type, protocol.CmdOutSend)
+			}
+		})
+	}
+}
+
+func TestClimateFor(t *testing.T) {
+	tests := []struct {
+		year    protocol.ModelYear
+		mode    protocol.ClimateMode
+		minutes int
+		delay   int
+		want    []string
+	}{
+		{protocol.ModelYear18, protocol.ClimateHeat, 20, 0, []string{"1b:02020100"}},
+		{protocol.ModelYear18, protocol.ClimateHeat, 10, 5, []string{"1b:02020001"}},
+		{protocol.ModelYear24, protocol.ClimateWindscreen, 10, 0, []string{"1b:02030000"}},
+		{protocol.ModelYear18, protocol.ClimateOff, 0, 0, []string{"1b:01000000"}},
+		{protocol.ModelYear14, protocol.ClimateCool, 30, 0, []string{"02:0000ffffffff03ffffffffffffffff", "04:02"}},
+		{protocol.ModelYear14, protocol.ClimateOff, 0, 0, []string{"02:0000ffffffff00ffffffffffffffff", "04:01"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.year.String()+"/"+test.mode.String(), func(t *testing.T) {
+			msgs, err := ClimateFor(test.year, test.mode, test.minutes, test.delay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgs) != len(test.want) {
+				t.Fatalf("got %d messages, want %d", len(msgs), len(test.want))
+			}
+			for i, m := range msgs {
+				if got := msgString(m); got != test.want[i] {
+					t.Errorf("message %d got=%s want=%s", i, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := SyncTime(time.Date(1999, time.January, 1, 0, 0, 0, 0, time.UTC), false); err == nil {
+		t.Error("time before 2000, want error")
+	}
+	if _, err := ClimateFor(protocol.ModelYearUnknown, protocol.ClimateHeat, 10, 0); err == nil {
+		t.Error("unknown model year, want error")
+	}
+	if _, err := ClimateFor(protocol.ModelYear18, protocol.ClimateHeat, 15, 0); err == nil {
+		t.Error("invalid duration, want error")
+	}
+	if _, err := ClimateFor(protocol.ModelYear18, protocol.ClimateHeat, 10, 3); err == nil {
+		t.Error("invalid delay, want error")
+	}
+	if _, err := ClimateFor(protocol.ModelYear14, protocol.ClimateHeat, 10, 5); err == nil {
+		t.Error("MY14 delay, want error")
+	}
+	if _, err := ClimateFor(protocol.ModelYear18, protocol.ClimateMode(0x4), 10, 0); err == nil {
+		t.Error("invalid mode, want error")
+	}
+}
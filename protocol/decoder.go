@@ -0,0 +1,274 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The smallest valid frame: type, length, ack, register and checksum.
+const minFrameLength = 5
+
+// The largest frame, whose length fits in PhevMessage.Length. A length
+// byte of 0xfe or 0xff gives a longer frame, which is never valid.
+const maxFrameLength = 0xff
+
+// A ResyncEvent reports bytes discarded while searching for the start
+// of a valid frame, such as after a corrupted or truncated packet.
+type ResyncEvent struct {
+	// Skipped are the raw bytes discarded.
+	Skipped []byte
+}
+
+func (e ResyncEvent) String() string {
+	return fmt.Sprintf("resync, skipped %d bytes: %s", len(e.Skipped), hex.EncodeToString(e.Skipped))
+}
+
+// hexBytes formats as hex when logged, so that the encoding is only
+// done if the log line is written.
+type hexBytes []byte
+
+func (b hexBytes) String() string {
+	return hex.EncodeToString(b)
+}
+
+// A Decoder reads messages from a stream. Frames split across reads
+// are buffered until complete, and the SecurityKey is updated as each
+// message is decoded.
+type Decoder struct {
+	// OnResync, if set, is called whenever bytes are skipped to find
+	// the next valid frame.
+	OnResync func(ResyncEvent)
+	// OnError, if set, is called with each decode error. These are
+	// also counted in Health, and do not stop decoding.
+	OnError func(error)
+	// Logger, if set, receives debug output. The SecurityKey's Logger
+	// is used if not set.
+	Logger Logger
+
+	r   io.Reader
+	key *SecurityKey
+	// buf holds data read from r, of which buf[off:] is not yet
+	// decoded. Reads go directly into its spare capacity.
+	buf     []byte
+	off     int
+	skipped []byte
+
+	mu     sync.Mutex
+	health Health
+}
+
+// The initial read buffer size of a Decoder. It grows if a read fills
+// it without completing a frame.
+const decoderBufferSize = 4096
+
+// NewDecoder returns a Decoder reading from r, using and updating key.
+func NewDecoder(r io.Reader, key *SecurityKey) *Decoder {
+	return &Decoder{
+		r:   r,
+		key: key,
+		buf: make([]byte, 0, decoderBufferSize),
+	}
+}
+
+// Health returns the count of messages and errors decoded so far. It
+// is safe to call concurrently with Decode.
+func (d *Decoder) Health() Health {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.health
+}
+
+// logger returns the Logger to use, or nil if none.
+func (d *Decoder) logger() Logger {
+	if d.Logger != nil {
+		return d.Logger
+	}
+	if d.key != nil {
+		return d.key.Logger
+	}
+	return nil
+}
+
+func (d *Decoder) record(err error) {
+	d.mu.Lock()
+	if err == nil {
+		d.health.Messages++
+	} else {
+		d.health.Record(err)
+	}
+	d.mu.Unlock()
+	if err != nil {
+		if l := d.logger(); l != nil {
+			l.Debugf("%%PHEV_DECODER_ERROR%%: %v", err)
+		}
+		if d.OnError != nil {
+			d.OnError(err)
+		}
+	}
+}
+
+// Buffered returns the number of bytes read but not yet decoded.
+func (d *Decoder) Buffered() int {
+	return len(d.buf) - d.off
+}
+
+// Decode returns the next message from the stream, reading as much as
+// needed. Any read error is returned as is, with buffered data kept
+// so that Decode may be called again after a timeout. At io.EOF, any
+// incomplete trailing frame is reported as a *ShortFrameError.
+func (d *Decoder) Decode() (*PhevMessage, error) {
+	p := &PhevMessage{}
+	if err := d.DecodeInto(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DecodeInto is as Decode, but decodes into p, reusing the buffers of
+// a message previously decoded into it. All of p is overwritten,
+// including Reg, whose data shares p's buffers, so a message must not
+// be kept once decoded into again. On error p is left unchanged.
+func (d *Decoder) DecodeInto(p *PhevMessage) error {
+	for {
+		if d.next(p) {
+			return nil
+		}
+		d.compact()
+		n, err := d.r.Read(d.buf[len(d.buf):cap(d.buf)])
+		if n > 0 {
+			if l := d.logger(); l != nil {
+				l.Tracef("%%PHEV_DECODER_READ%%: %s", hexBytes(d.buf[len(d.buf):len(d.buf)+n]))
+			}
+			d.buf = d.buf[:len(d.buf)+n]
+			continue
+		}
+		if err == io.EOF {
+			d.resynced()
+			if d.Buffered() > 0 {
+				d.record(&ShortFrameError{Data: append([]byte{}, d.buf[d.off:]...)})
+				d.buf, d.off = d.buf[:0], 0
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// compact moves undecoded data to the start of the buffer, to make
+// room to read into. The buffer grows if there is still no room.
+func (d *Decoder) compact() {
+	n := copy(d.buf, d.buf[d.off:])
+	d.buf, d.off = d.buf[:n], 0
+	if n < cap(d.buf) {
+		return
+	}
+	size := 2 * cap(d.buf)
+	if size < decoderBufferSize {
+		size = decoderBufferSize
+	}
+	buf := make([]byte, n, size)
+	copy(buf, d.buf)
+	d.buf = buf
+}
+
+// next decodes a message from the buffer into p, returning false if
+// more data is needed.
+func (d *Decoder) next(p *PhevMessage) bool {
+	for d.Buffered() >= minFrameLength {
+		buf := d.buf[d.off:]
+		length, xor, status := frameAt(buf)
+		switch status {
+		case framePartial:
+			return false
+		case frameInvalid:
+			d.skipped = append(d.skipped, buf[0])
+			d.off++
+			continue
+		}
+		d.resynced()
+		d.off += length
+		err := p.decode(buf, length, xor, p.frameBuffer(length), d.key)
+		switch err.(type) {
+		case nil:
+		case *UnknownTypeError, *RegisterLengthError:
+			// The message is still decoded.
+			d.record(err)
+		default:
+			d.record(err)
+			continue
+		}
+		d.record(nil)
+		return true
+	}
+	return false
+}
+
+func (d *Decoder) resynced() {
+	if len(d.skipped) == 0 {
+		return
+	}
+	e := ResyncEvent{Skipped: d.skipped}
+	d.skipped = nil
+	if l := d.logger(); l != nil {
+		l.Debugf("%%PHEV_DECODER_RESYNC%%: %s", e)
+	}
+	if d.OnResync != nil {
+		d.OnResync(e)
+	}
+	d.record(&ChecksumError{Data: e.Skipped})
+}
+
+type frameStatus int
+
+const (
+	frameInvalid frameStatus = iota
+	framePartial
+	frameValid
+)
+
+// Message types that may start a frame, used to decide whether an
+// incomplete frame is worth waiting for.
+var frameTypes = map[byte]bool{
+	CmdOutPingReq:       true,
+	CmdInPingResp:       true,
+	CmdOutSend:          true,
+	CmdInResp:           true,
+	CmdInMy24StartReq:   true,
+	CmdOutMy24StartResp: true,
+	CmdInMy18StartReq:   true,
+	CmdOutMy18StartResp: true,
+	CmdInMy14StartReq:   true,
+	CmdOutMy14StartResp: true,
+	CmdInBadEncoding:    true,
+	CmdInUnkn3:          true,
+	CmdInStartResp:      true,
+	CmdOutStartSendMy18: true,
+	CmdInUnkn4:          true,
+}
+
+// frameAt checks for a frame at the start of buf. The ack byte is 0x0
+// or 0x1 before XORing, so there are two candidate XOR values, each
+// giving a frame length. A candidate longer than buf, with a known
+// message type, may yet become valid when more data arrives.
+func frameAt(buf []byte) (int, byte, frameStatus) {
+	status := frameInvalid
+	for _, xor := range []byte{buf[2], buf[2] ^ 1} {
+		length := int(buf[1]^xor) + 2
+		switch {
+		case length < minFrameLength, length > maxFrameLength:
+			continue
+		case length > len(buf):
+			if frameTypes[buf[0]^xor] {
+				status = framePartial
+			}
+			continue
+		}
+		if _, ok := validFrame(buf, xor); ok {
+			return length, xor, frameValid
+		}
+	}
+	return 0, 0, status
+}
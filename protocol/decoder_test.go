@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+// chunkReader returns each chunk from a separate Read call.
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if len(r.chunks[0]) == 0 {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestDecoder(t *testing.T) {
+	mustHex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	// Register 0x1e notification, XORed with 0xb7.
+	frame := mustHex("d8b2b7a9b7b725")
+	ping := NewPingRequestMessage(0xa).EncodeToBytes(&SecurityKey{})
+
+	tests := []struct {
+		name    string
+		chunks  [][]byte
+		want    []byte
+		resyncs int
+	}{
+		{
+			name:   "whole",
+			chunks: [][]byte{append(append([]byte{}, frame...), ping...)},
+			want:   []byte{0x1e, 0xa},
+		}, {
+			name:   "split",
+			chunks: [][]byte{frame[:3], append(append([]byte{}, frame[3:]...), ping[:2]...), ping[2:]},
+			want:   []byte{0x1e, 0xa},
+		}, {
+			name:    "garbage",
+			chunks:  [][]byte{{0x00, 0x01}, frame[:4], frame[4:], {0xff}, ping},
+			want:    []byte{0x1e, 0xa},
+			resyncs: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDecoder(&chunkReader{chunks: test.chunks}, &SecurityKey{})
+			resyncs := 0
+			d.OnResync = func(ResyncEvent) { resyncs++ }
+			got := []byte{}
+			for {
+				m, err := d.Decode()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, m.Register)
+			}
+			if diff := hexCmp(got, hex.EncodeToString(test.want)); diff != "" {
+				t.Errorf("registers %s", diff)
+			}
+			if resyncs != test.resyncs {
+				t.Errorf("resyncs got=%d want=%d", resyncs, test.resyncs)
+			}
+			if d.Buffered() != 0 {
+				t.Errorf("Buffered() got=%d want=0", d.Buffered())
+			}
+		})
+	}
+}
+
+// overlongFrame returns a frame whose length byte is 0xff, giving 257
+// bytes, with a valid checksum.
+func overlongFrame() []byte {
+	frame := bytes.Repeat([]byte{0x55}, 0xff+2)
+	copy(frame, []byte{0x6f, 0xff, 0x00, 0x12})
+	var sum byte
+	for _, b := range frame[:len(frame)-1] {
+		sum += b
+	}
+	frame[len(frame)-1] = sum
+	return frame
+}
+
+func TestDecodeBytesOverlongFrame(t *testing.T) {
+	msgs, errs := DecodeBytes(overlongFrame(), &SecurityKey{})
+	if len(msgs) != 0 {
+		t.Errorf("got %d messages want=0", len(msgs))
+	}
+	if len(errs) == 0 {
+		t.Errorf("got no errors")
+	}
+	if err := (&PhevMessage{}).DecodeFromBytes(overlongFrame(), &SecurityKey{}); err == nil {
+		t.Errorf("DecodeFromBytes got no error")
+	}
+}
+
+func TestDecoderOverlongFrame(t *testing.T) {
+	ping := NewPingRequestMessage(0xa).EncodeToBytes(&SecurityKey{})
+	d := NewDecoder(&chunkReader{chunks: [][]byte{overlongFrame(), ping}}, &SecurityKey{})
+	resyncs := 0
+	d.OnResync = func(ResyncEvent) { resyncs++ }
+	m, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Register != 0xa {
+		t.Errorf("got register=0x%02x want=0x0a", m.Register)
+	}
+	if resyncs != 1 {
+		t.Errorf("resyncs got=%d want=1", resyncs)
+	}
+}
+
+// loopReader reads data over and over.
+type loopReader struct {
+	data []byte
+	off  int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+func TestDecodeInto(t *testing.T) {
+	// Register 0x1e notification, then register 0x02.
+	stream, err := hex.DecodeString("d8b2b7a9b7b725" + "6f0500020100" + "77")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecoder(&chunkReader{chunks: [][]byte{stream}}, &SecurityKey{})
+	p := &PhevMessage{}
+	if err := d.DecodeInto(p); err != nil {
+		t.Fatal(err)
+	}
+	if diff := hexCmp(p.Original, "6f05001e000092"); diff != "" {
+		t.Errorf("first Original %s", diff)
+	}
+	if err := d.DecodeInto(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Register != 0x02 || p.Xor != 0 {
+		t.Errorf("second got register=0x%02x xor=0x%02x want register=0x02 xor=0x00", p.Register, p.Xor)
+	}
+	if diff := hexCmp(p.OriginalXored, "6f050002010077"); diff != "" {
+		t.Errorf("second OriginalXored %s", diff)
+	}
+	if diff := hexCmp(p.Data, "0100"); diff != "" {
+		t.Errorf("second Data %s", diff)
+	}
+	if err := d.DecodeInto(p); err != io.EOF {
+		t.Errorf("got err=%v want=%v", err, io.EOF)
+	}
+}
+
+func BenchmarkDecoderDecodeInto(b *testing.B) {
+	data, err := hex.DecodeString("d8b2b7a9b7b725" + "ff879094eda82091132d9091ece0a891906f6f93906f6f93c8")
+	if err != nil {
+		b.Fatal(err)
+	}
+	d := NewDecoder(&loopReader{data: data}, &SecurityKey{})
+	p := &PhevMessage{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := d.DecodeInto(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
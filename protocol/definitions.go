@@ -0,0 +1,362 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A RegisterNumber is a register in a definition file, either as a
+// number or a string such as "0x21".
+type RegisterNumber byte
+
+func parseRegisterNumber(v interface{}) (RegisterNumber, error) {
+	switch n := v.(type) {
+	case int:
+		if n >= 0 && n <= 0xff {
+			return RegisterNumber(n), nil
+		}
+	case float64:
+		if n >= 0 && n <= 0xff && n == float64(int(n)) {
+			return RegisterNumber(n), nil
+		}
+	case string:
+		if r, err := strconv.ParseUint(n, 0, 8); err == nil {
+			return RegisterNumber(r), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid register number: %v", v)
+}
+
+func (r *RegisterNumber) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	n, err := parseRegisterNumber(v)
+	*r = n
+	return err
+}
+
+func (r *RegisterNumber) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	n, err := parseRegisterNumber(v)
+	*r = n
+	return err
+}
+
+// A RegisterDefinition describes the fields of a register, so that it
+// can be decoded without a compiled decoder.
+type RegisterDefinition struct {
+	Register RegisterNumber `json:"register" yaml:"register"`
+	// Name identifies the register, and is the default topic for its
+	// fields.
+	Name string `json:"name" yaml:"name"`
+	// Topic, if set, is used instead of Name when publishing fields.
+	Topic string `json:"topic,omitempty" yaml:"topic,omitempty"`
+	// Length is the expected data length, or 0 for any length. Fields
+	// beyond the data are not decoded.
+	Length int `json:"length,omitempty" yaml:"length,omitempty"`
+	// ModelYear restricts the definition to a model year (14, 18 or 24).
+	// By default it applies to all model years.
+	ModelYear int                `json:"model_year,omitempty" yaml:"model_year,omitempty"`
+	Fields    []*FieldDefinition `json:"fields" yaml:"fields"`
+}
+
+// A FieldDefinition describes a field within a register. A field is
+// either Bits wide starting at bit Bit of byte Byte, or Size whole
+// bytes starting at Byte.
+type FieldDefinition struct {
+	Name string `json:"name" yaml:"name"`
+	Byte int    `json:"byte" yaml:"byte"`
+	// Bit is the least significant bit of a bit field, 0-7.
+	Bit int `json:"bit,omitempty" yaml:"bit,omitempty"`
+	// Bits is the width of a bit field, which may span bytes. Zero
+	// for a whole byte field.
+	Bits int `json:"bits,omitempty" yaml:"bits,omitempty"`
+	// Size is the number of bytes of a whole byte field, default 1.
+	Size         int  `json:"size,omitempty" yaml:"size,omitempty"`
+	LittleEndian bool `json:"little_endian,omitempty" yaml:"little_endian,omitempty"`
+	Signed       bool `json:"signed,omitempty" yaml:"signed,omitempty"`
+	// The value is raw*Scale + Offset. Scale defaults to 1.
+	Scale  float64 `json:"scale,omitempty" yaml:"scale,omitempty"`
+	Offset float64 `json:"offset,omitempty" yaml:"offset,omitempty"`
+	Unit   string  `json:"unit,omitempty" yaml:"unit,omitempty"`
+	// Enum names raw values.
+	Enum map[int64]string `json:"enum,omitempty" yaml:"enum,omitempty"`
+}
+
+// bits returns the field width in bits, and the number of bytes it
+// spans from Byte.
+func (f *FieldDefinition) bits() (int, int) {
+	if f.Bits > 0 {
+		return f.Bits, (f.Bit + f.Bits + 7) / 8
+	}
+	size := f.Size
+	if size == 0 {
+		size = 1
+	}
+	return size * 8, size
+}
+
+func (f *FieldDefinition) validate(length int) error {
+	width, span := f.bits()
+	switch {
+	case f.Name == "":
+		return fmt.Errorf("field at byte %d has no name", f.Byte)
+	case f.Byte < 0:
+		return fmt.Errorf("field %s: negative byte offset", f.Name)
+	case f.Bit < 0 || f.Bit > 7:
+		return fmt.Errorf("field %s: bit must be 0-7: %d", f.Name, f.Bit)
+	case f.Bit != 0 && f.Bits == 0:
+		return fmt.Errorf("field %s: bit is only for bit fields, with bits set", f.Name)
+	case f.Bits < 0 || f.Size < 0:
+		return fmt.Errorf("field %s: negative size", f.Name)
+	case f.Bits > 0 && f.Size > 0:
+		return fmt.Errorf("field %s: only one of bits and size may be set", f.Name)
+	case width > 64 || span > 8:
+		return fmt.Errorf("field %s: wider than 64 bits", f.Name)
+	case length > 0 && f.Byte+span > length:
+		return fmt.Errorf("field %s: beyond register length %d", f.Name, length)
+	}
+	return nil
+}
+
+func (d *RegisterDefinition) validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("register 0x%02x has no name", byte(d.Register))
+	}
+	if d.Length < 0 {
+		return fmt.Errorf("register %s: negative length", d.Name)
+	}
+	if _, err := d.modelYear(); err != nil {
+		return fmt.Errorf("register %s: %v", d.Name, err)
+	}
+	names := map[string]bool{}
+	for _, f := range d.Fields {
+		if err := f.validate(d.Length); err != nil {
+			return fmt.Errorf("register %s: %v", d.Name, err)
+		}
+		if names[f.Name] {
+			return fmt.Errorf("register %s: duplicate field %s", d.Name, f.Name)
+		}
+		names[f.Name] = true
+	}
+	return nil
+}
+
+func (d *RegisterDefinition) modelYear() (ModelYear, error) {
+	switch d.ModelYear {
+	case 0:
+		return ModelYearUnknown, nil
+	case 14:
+		return ModelYear14, nil
+	case 18:
+		return ModelYear18, nil
+	case 24:
+		return ModelYear24, nil
+	}
+	return ModelYearUnknown, fmt.Errorf("invalid model year %d", d.ModelYear)
+}
+
+// TopicName returns the topic to publish the register's fields under.
+func (d *RegisterDefinition) TopicName() string {
+	if d.Topic != "" {
+		return d.Topic
+	}
+	return d.Name
+}
+
+// ParseDefinitions parses register definitions from YAML or JSON (as
+// a subset of YAML), validating them.
+func ParseDefinitions(r io.Reader) ([]*RegisterDefinition, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var defs struct {
+		Registers []*RegisterDefinition `json:"registers" yaml:"registers"`
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&defs)
+	} else {
+		err = yaml.UnmarshalStrict(data, &defs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing register definitions: %v", err)
+	}
+	for _, d := range defs.Registers {
+		if err := d.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return defs.Registers, nil
+}
+
+// LoadDefinitionFile parses a register definition file, then installs
+// a decoder for each register defined. These replace any built in
+// decoder for the same register.
+func LoadDefinitionFile(filename string) ([]*RegisterDefinition, error) {
+	f, err := os.Open(filepath.Clean(filename))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defs, err := ParseDefinitions(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	InstallDefinitions(defs)
+	return defs, nil
+}
+
+// InstallDefinitions installs a decoder for each register definition.
+func InstallDefinitions(defs []*RegisterDefinition) {
+	for _, d := range defs {
+		d := d
+		year, _ := d.modelYear()
+		RegisterModelDecoder(byte(d.Register), year, func() Register {
+			return &RegisterDefined{Definition: d}
+		})
+	}
+}
+
+// A FieldValue is a decoded field of a RegisterDefined.
+type FieldValue struct {
+	Name string `json:"name"`
+	// Raw is the value before scaling.
+	Raw int64 `json:"raw"`
+	// Value is the scaled value.
+	Value float64 `json:"value"`
+	// Enum is the name of the value, if the field has one for it.
+	Enum string `json:"enum,omitempty"`
+	Unit string `json:"unit,omitempty"`
+}
+
+// String returns the enum name, or the scaled value.
+func (v FieldValue) String() string {
+	if v.Enum != "" {
+		return v.Enum
+	}
+	return strconv.FormatFloat(v.Value, 'f', -1, 64)
+}
+
+// RegisterDefined is a register decoded from a RegisterDefinition.
+type RegisterDefined struct {
+	Definition *RegisterDefinition
+	// Fields holds the decoded fields, in definition order. Fields
+	// beyond the end of the data are omitted.
+	Fields []FieldValue
+	raw    []byte
+}
+
+func (r *RegisterDefined) Decode(m *PhevMessage) {
+	if m.Register != byte(r.Definition.Register) {
+		return
+	}
+	if r.Definition.Length > 0 && len(m.Data) != r.Definition.Length {
+		return
+	}
+	r.raw = m.Data
+	r.Fields = nil
+	for _, f := range r.Definition.Fields {
+		if v, ok := decodeField(f, m.Data); ok {
+			r.Fields = append(r.Fields, v)
+		}
+	}
+}
+
+func decodeField(f *FieldDefinition, data []byte) (FieldValue, bool) {
+	width, span := f.bits()
+	if f.Byte+span > len(data) {
+		return FieldValue{}, false
+	}
+	b := make([]byte, 8)
+	if f.LittleEndian {
+		copy(b, data[f.Byte:f.Byte+span])
+	} else {
+		for i := 0; i < span; i++ {
+			b[i] = data[f.Byte+span-1-i]
+		}
+	}
+	u := binary.LittleEndian.Uint64(b)
+	if f.Bits > 0 {
+		u >>= uint(f.Bit)
+	}
+	if width < 64 {
+		u &= 1<<uint(width) - 1
+	}
+	raw := int64(u)
+	if f.Signed && width < 64 && u&(1<<uint(width-1)) != 0 {
+		raw -= 1 << uint(width)
+	}
+	scale := f.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return FieldValue{
+		Name:  f.Name,
+		Raw:   raw,
+		Value: float64(raw)*scale + f.Offset,
+		Enum:  f.Enum[raw],
+		Unit:  f.Unit,
+	}, true
+}
+
+func (r *RegisterDefined) Encode() *PhevMessage {
+	return &PhevMessage{
+		Register: r.Register(),
+		Data:     r.raw,
+	}
+}
+
+func (r *RegisterDefined) Raw() string {
+	return hex.EncodeToString(r.raw)
+}
+
+func (r *RegisterDefined) String() string {
+	fields := []string{}
+	for _, f := range r.Fields {
+		s := fmt.Sprintf("%s=%s", f.Name, f)
+		if f.Unit != "" && f.Enum == "" {
+			s += f.Unit
+		}
+		fields = append(fields, s)
+	}
+	return fmt.Sprintf("%s: %s", r.Definition.Name, strings.Join(fields, " "))
+}
+
+func (r *RegisterDefined) Register() byte {
+	return byte(r.Definition.Register)
+}
+
+// MarshalJSON encodes the fields as an object keyed by field name, each
+// the enum name if there is one, or the scaled value.
+func (r *RegisterDefined) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{}
+	for _, f := range r.Fields {
+		if f.Enum != "" {
+			fields[f.Name] = f.Enum
+		} else {
+			fields[f.Name] = f.Value
+		}
+	}
+	return marshalRegister(r, struct {
+		Name   string                 `json:"name"`
+		Fields map[string]interface{} `json:"fields"`
+	}{r.Definition.Name, fields})
+}
@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gopkg.in/d4l3k/messagediff.v1"
+)
+
+const testDefinitionsYAML = `
+registers:
+  - register: 0x21
+    name: test_register
+    length: 4
+    fields:
+      - name: mode
+        byte: 0
+        enum:
+          0: off
+          1: eco
+      - name: flag
+        byte: 1
+        bit: 3
+        bits: 1
+      - name: temperature
+        byte: 2
+        signed: true
+        scale: 0.5
+        offset: 1
+        unit: C
+      - name: counter
+        byte: 2
+        size: 2
+        little_endian: true
+`
+
+const testDefinitionsJSON = `{
+  "registers": [{
+    "register": "0x21",
+    "name": "test_register",
+    "length": 4,
+    "fields": [
+      {"name": "mode", "byte": 0, "enum": {"0": "off", "1": "eco"}},
+      {"name": "flag", "byte": 1, "bit": 3, "bits": 1},
+      {"name": "temperature", "byte": 2, "signed": true, "scale": 0.5, "offset": 1, "unit": "C"},
+      {"name": "counter", "byte": 2, "size": 2, "little_endian": true}
+    ]
+  }]
+}`
+
+func TestDefinitions(t *testing.T) {
+	defer UnregisterDecoder(0x21, ModelYearUnknown)
+
+	for name, in := range map[string]string{"yaml": testDefinitionsYAML, "json": testDefinitionsJSON} {
+		t.Run(name, func(t *testing.T) {
+			defs, err := ParseDefinitions(strings.NewReader(in))
+			if err != nil {
+				t.Fatalf("ParseDefinitions(): %v", err)
+			}
+			InstallDefinitions(defs)
+
+			m := &PhevMessage{Type: CmdInResp, Ack: Request, Register: 0x21, Data: []byte{0x01, 0x08, 0xfc, 0x01}}
+			m.Reg = NewRegister(m.Register, ModelYear18)
+			m.Reg.Decode(m)
+			reg, ok := m.Reg.(*RegisterDefined)
+			if !ok {
+				t.Fatalf("NewRegister() got=%T want *RegisterDefined", m.Reg)
+			}
+			want := []FieldValue{
+				{Name: "mode", Raw: 1, Value: 1, Enum: "eco"},
+				{Name: "flag", Raw: 1, Value: 1},
+				{Name: "temperature", Raw: -4, Value: -1, Unit: "C"},
+				{Name: "counter", Raw: 0x01fc, Value: 0x01fc},
+			}
+			if diff, equal := messagediff.PrettyDiff(want, reg.Fields); !equal {
+				t.Errorf("Fields diff=%s", diff)
+			}
+			if got, want := reg.String(), "test_register: mode=eco flag=1 temperature=-1C counter=508"; got != want {
+				t.Errorf("String() got=%q want=%q", got, want)
+			}
+			b, err := json.Marshal(reg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(b), `{"register":"0x21","raw":"0108fc01","name":"test_register","fields":{"counter":508,"flag":1,"mode":"eco","temperature":-1}}`; got != want {
+				t.Errorf("MarshalJSON() got=%s want=%s", got, want)
+			}
+			if err := checkRegisterLength(m, ModelYear18); err != nil {
+				t.Errorf("checkRegisterLength(): %v", err)
+			}
+			m.Data = m.Data[:3]
+			if err := checkRegisterLength(m, ModelYear18); err == nil {
+				t.Error("checkRegisterLength() short data, want error")
+			}
+		})
+	}
+}
+
+func TestDefinitionsInvalid(t *testing.T) {
+	for name, in := range map[string]string{
+		"no name":          `registers: [{register: 0x21, fields: []}]`,
+		"bad register":     `registers: [{register: 0x100, name: a}]`,
+		"bad model year":   `registers: [{register: 0x21, name: a, model_year: 15}]`,
+		"unknown key":      `registers: [{register: 0x21, name: a, colour: red}]`,
+		"beyond length":    `registers: [{register: 0x21, name: a, length: 2, fields: [{name: f, byte: 1, size: 2}]}]`,
+		"bad bit":          `registers: [{register: 0x21, name: a, fields: [{name: f, byte: 0, bit: 8, bits: 1}]}]`,
+		"bits and size":    `registers: [{register: 0x21, name: a, fields: [{name: f, byte: 0, bits: 1, size: 1}]}]`,
+		"too wide":         `registers: [{register: 0x21, name: a, fields: [{name: f, byte: 0, size: 9}]}]`,
+		"duplicate field":  `registers: [{register: 0x21, name: a, fields: [{name: f, byte: 0}, {name: f, byte: 1}]}]`,
+		"bit without bits": `registers: [{register: 0x21, name: a, fields: [{name: f, byte: 0, bit: 3}]}]`,
+		"json unknown key": `{"registers": [{"register": 33, "name": "a", "colour": "red"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseDefinitions(strings.NewReader(in)); err == nil {
+				t.Error("ParseDefinitions() want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// A ShortFrameError is returned when data ends before a complete frame.
+type ShortFrameError struct {
+	Data []byte
+}
+
+func (e *ShortFrameError) Error() string {
+	return fmt.Sprintf("short frame, got %d bytes: %s", len(e.Data), hex.EncodeToString(e.Data))
+}
+
+// A ChecksumError is returned when no valid frame is found in data, as
+// the checksum does not match with either candidate XOR value.
+type ChecksumError struct {
+	Data []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("bad checksum, skipped %d bytes: %s", len(e.Data), hex.EncodeToString(e.Data))
+}
+
+// An UnknownTypeError is returned for a valid frame with a message type
+// that is not understood. The message is still decoded.
+type UnknownTypeError struct {
+	Type byte
+}
+
+func (e *UnknownTypeError) Error() string {
+	return fmt.Sprintf("unknown message type 0x%02x", e.Type)
+}
+
+// A RegisterLengthError is returned when a register has a length its
+// decoder does not expect, so its typed fields are not set.
+type RegisterLengthError struct {
+	Register byte
+	Got      int
+	Want     []int
+}
+
+func (e *RegisterLengthError) Error() string {
+	return fmt.Sprintf("register 0x%02x unexpected length %d, want %v", e.Register, e.Got, e.Want)
+}
+
+// Data lengths expected by the typed register decoders. Registers
+// whose length differs by model year are described by the Profile.
+var fixedRegisterLengths = map[byte][]int{
+	VINRegister:            {20},
+	SettingsRegister:       {8},
+	TimeRegister:           {7},
+	ECUVersionRegister:     {13},
+	BatteryLevelRegister:   {4},
+	BatteryWarningRegister: {4},
+	DoorStatusRegister:     {10},
+	ChargePlugRegister:     {2},
+	ChargeStatusRegister:   {3},
+	ACModeRegister:         {1},
+	WIFISSIDRegister:       {32},
+	LightStatusRegister:    {5},
+}
+
+// expectedLengths returns the valid data lengths of a register for a
+// model year, or nil if not known. For an unknown model year, the
+// length from any model year is accepted.
+func expectedLengths(register byte, year ModelYear) []int {
+	if l, ok := fixedRegisterLengths[register]; ok {
+		return l
+	}
+	if year != ModelYearUnknown {
+		if l := ProfileFor(year).RegisterLength(register); l > 0 {
+			return []int{l}
+		}
+		return nil
+	}
+	var want []int
+	for _, y := range []ModelYear{ModelYear14, ModelYear18} {
+		if l := ProfileFor(y).RegisterLength(register); l > 0 {
+			want = append(want, l)
+		}
+	}
+	return want
+}
+
+// checkRegisterLength returns a RegisterLengthError if the register in
+// m has an unexpected length for the model year, or for its definition
+// if loaded from a definition file.
+func checkRegisterLength(m *PhevMessage, year ModelYear) error {
+	want := expectedLengths(m.Register, year)
+	if d, ok := m.Reg.(*RegisterDefined); ok {
+		want = nil
+		if d.Definition.Length > 0 {
+			want = []int{d.Definition.Length}
+		}
+	}
+	if want == nil {
+		return nil
+	}
+	for _, l := range want {
+		if len(m.Data) == l {
+			return nil
+		}
+	}
+	return &RegisterLengthError{Register: m.Register, Got: len(m.Data), Want: want}
+}
+
+// Health counts decoded messages and decode errors, as a measure of
+// how well the protocol is being understood.
+type Health struct {
+	Messages        int `json:"messages"`
+	ShortFrames     int `json:"short_frames"`
+	BadChecksums    int `json:"bad_checksums"`
+	SkippedBytes    int `json:"skipped_bytes"`
+	UnknownTypes    int `json:"unknown_types"`
+	RegisterLengths int `json:"register_lengths"`
+	Other           int `json:"other"`
+}
+
+// Record counts a decode error by its type.
+func (h *Health) Record(err error) {
+	switch e := err.(type) {
+	case nil:
+	case *ShortFrameError:
+		h.ShortFrames++
+	case *ChecksumError:
+		h.BadChecksums++
+		h.SkippedBytes += len(e.Data)
+	case *UnknownTypeError:
+		h.UnknownTypes++
+	case *RegisterLengthError:
+		h.RegisterLengths++
+	default:
+		h.Other++
+	}
+}
+
+// Errors returns the total number of errors recorded.
+func (h Health) Errors() int {
+	return h.ShortFrames + h.BadChecksums + h.UnknownTypes + h.RegisterLengths + h.Other
+}
+
+func (h Health) String() string {
+	return fmt.Sprintf("%d messages, %d errors (%d short frames, %d bad checksums over %d bytes, %d unknown types, %d bad register lengths, %d other)",
+		h.Messages, h.Errors(), h.ShortFrames, h.BadChecksums, h.SkippedBytes, h.UnknownTypes, h.RegisterLengths, h.Other)
+}
@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"gopkg.in/d4l3k/messagediff.v1"
+)
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want error
+	}{
+		{
+			name: "valid",
+			in:   "6f05001e000092",
+		}, {
+			name: "short",
+			in:   "6f05",
+			want: &ShortFrameError{Data: []byte{0x6f, 0x05}},
+		}, {
+			name: "truncated",
+			in:   "6f05001e00",
+			want: &ShortFrameError{Data: []byte{0x6f, 0x05, 0x00, 0x1e, 0x00}},
+		}, {
+			name: "checksum",
+			in:   "f6040006030400",
+			want: &ChecksumError{Data: []byte{0xf6, 0x04, 0x00, 0x06, 0x03, 0x04, 0x00}},
+		}, {
+			name: "unknown type",
+			in:   "77040001007c",
+			want: &UnknownTypeError{Type: 0x77},
+		}, {
+			name: "register length",
+			in:   "6f040002057a",
+			want: &RegisterLengthError{Register: BatteryWarningRegister, Got: 1, Want: []int{4}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in, err := hex.DecodeString(test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &PhevMessage{}
+			err = p.DecodeFromBytes(in, &SecurityKey{})
+			if diff, equal := messagediff.PrettyDiff(test.want, err); !equal {
+				t.Errorf("DecodeFromBytes() error diff=%s", diff)
+			}
+		})
+	}
+}
+
+func TestRegisterLengthByModelYear(t *testing.T) {
+	// A MY'14 pre-AC state register is a single byte.
+	in, err := hex.DecodeString("6f0400100285")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		year ModelYear
+		want error
+	}{
+		{ModelYearUnknown, nil},
+		{ModelYear14, nil},
+		{ModelYear18, &RegisterLengthError{Register: PreACStateRegister, Got: 1, Want: []int{3}}},
+	}
+	for _, test := range tests {
+		t.Run(test.year.String(), func(t *testing.T) {
+			p := &PhevMessage{}
+			err := p.DecodeFromBytes(in, &SecurityKey{modelYear: test.year})
+			if diff, equal := messagediff.PrettyDiff(test.want, err); !equal {
+				t.Errorf("DecodeFromBytes() error diff=%s", diff)
+			}
+		})
+	}
+}
+
+func TestDecodeBytesHealth(t *testing.T) {
+	in, err := hex.DecodeString("6f05001e000092" + "77040001007c" + "6f040002057a" + "f6040006030400" + "6f05001e000092" + "6f05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, errs := DecodeBytes(in, &SecurityKey{})
+	if got, want := len(msgs), 4; got != want {
+		t.Errorf("messages got=%d want=%d", got, want)
+	}
+	var h Health
+	gotTypes := []string{}
+	for _, err := range errs {
+		h.Record(err)
+		gotTypes = append(gotTypes, reflect.TypeOf(err).String())
+	}
+	wantTypes := []string{"*protocol.UnknownTypeError", "*protocol.RegisterLengthError", "*protocol.ChecksumError", "*protocol.ShortFrameError"}
+	if diff, equal := messagediff.PrettyDiff(wantTypes, gotTypes); !equal {
+		t.Errorf("error types diff=%s", diff)
+	}
+	want := Health{ShortFrames: 1, BadChecksums: 1, SkippedBytes: 7, UnknownTypes: 1, RegisterLengths: 1}
+	if diff, equal := messagediff.PrettyDiff(want, h); !equal {
+		t.Errorf("Health diff=%s", diff)
+	}
+	if got, want := h.Errors(), 4; got != want {
+		t.Errorf("Errors() got=%d want=%d", got, want)
+	}
+}
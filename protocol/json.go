@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// registerJSON holds the fields common to the JSON form of every
+// register. Each register's own fields are flattened alongside it.
+type registerJSON struct {
+	Register string `json:"register"`
+	Raw      string `json:"raw,omitempty"`
+}
+
+func newRegisterJSON(r Register) registerJSON {
+	return registerJSON{
+		Register: fmt.Sprintf("0x%02x", r.Register()),
+		Raw:      r.Raw(),
+	}
+}
+
+// marshalRegister encodes the common register fields followed by the
+// JSON object fields. To avoid recursing into MarshalJSON, fields is
+// the register converted to a type without methods.
+func marshalRegister(r Register, fields interface{}) ([]byte, error) {
+	common, err := json.Marshal(newRegisterJSON(r))
+	if err != nil {
+		return nil, err
+	}
+	own, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	if len(own) <= 2 {
+		// No fields of its own, "{}".
+		return common, nil
+	}
+	common[len(common)-1] = ','
+	return append(common, own[1:]...), nil
+}
+
+func (r *RegisterGeneric) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newRegisterJSON(r))
+}
+
+func (r *RegisterTime) MarshalJSON() ([]byte, error) {
+	type fields RegisterTime
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterSettings) MarshalJSON() ([]byte, error) {
+	type fields RegisterSettings
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterVIN) MarshalJSON() ([]byte, error) {
+	type fields RegisterVIN
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterECUVersion) MarshalJSON() ([]byte, error) {
+	type fields RegisterECUVersion
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterBatteryLevel) MarshalJSON() ([]byte, error) {
+	type fields RegisterBatteryLevel
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterBatteryWarning) MarshalJSON() ([]byte, error) {
+	type fields RegisterBatteryWarning
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterDoorStatus) MarshalJSON() ([]byte, error) {
+	type fields RegisterDoorStatus
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterChargeStatus) MarshalJSON() ([]byte, error) {
+	type fields RegisterChargeStatus
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterPreACState) MarshalJSON() ([]byte, error) {
+	type fields RegisterPreACState
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterACOperStatus) MarshalJSON() ([]byte, error) {
+	type fields RegisterACOperStatus
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterACMode) MarshalJSON() ([]byte, error) {
+	type fields RegisterACMode
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterChargePlug) MarshalJSON() ([]byte, error) {
+	type fields RegisterChargePlug
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterWIFISSID) MarshalJSON() ([]byte, error) {
+	type fields RegisterWIFISSID
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterLightStatus) MarshalJSON() ([]byte, error) {
+	type fields RegisterLightStatus
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterClimateSchedule) MarshalJSON() ([]byte, error) {
+	type fields RegisterClimateSchedule
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (r *RegisterChargeSchedule) MarshalJSON() ([]byte, error) {
+	type fields RegisterChargeSchedule
+	return marshalRegister(r, (*fields)(r))
+}
+
+func (s PreACState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (i IgnitionState) MarshalText() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+// MarshalJSON encodes the days as a list of names, sunday first.
+func (w Weekdays) MarshalJSON() ([]byte, error) {
+	days := []string{}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if w.Has(d) {
+			days = append(days, d.String())
+		}
+	}
+	return json.Marshal(days)
+}
+
+// MarshalJSON includes the setting and value names alongside the raw
+// values.
+func (s Setting) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID        byte   `json:"id"`
+		Name      string `json:"name"`
+		Value     int    `json:"value"`
+		ValueName string `json:"value_name"`
+		Options   uint8  `json:"options,omitempty"`
+	}{byte(s.ID), s.ID.String(), s.Value, s.ValueString(), s.Options})
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// A Logger receives debug output from the protocol package. It is
+// satisfied by *logrus.Logger and *logrus.Entry, and slog is supported
+// via SlogLogger. Output is discarded if no Logger is set.
+type Logger interface {
+	Tracef(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+}
+
+// LevelTrace is the slog level used for trace output, below debug.
+const LevelTrace = slog.LevelDebug - 4
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// SlogLogger returns a Logger writing to l. Trace output is logged at
+// LevelTrace.
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l: l}
+}
+
+func (s slogLogger) logf(level slog.Level, format string, args []interface{}) {
+	ctx := context.Background()
+	if s.l.Enabled(ctx, level) {
+		s.l.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (s slogLogger) Tracef(format string, args ...interface{}) {
+	s.logf(LevelTrace, format, args)
+}
+
+func (s slogLogger) Debugf(format string, args ...interface{}) {
+	s.logf(slog.LevelDebug, format, args)
+}
+
+func (s slogLogger) Infof(format string, args ...interface{}) {
+	s.logf(slog.LevelInfo, format, args)
+}
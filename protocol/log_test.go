@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Tracef(format string, args ...interface{}) {
+	l.lines = append(l.lines, "trace: "+fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "debug: "+fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.lines = append(l.lines, "info: "+fmt.Sprintf(format, args...))
+}
+
+func TestLogger(t *testing.T) {
+	vin := (&RegisterVIN{VIN: "JMFXDGG2WJZ00048", Registrations: 2}).Encode()
+	vin.Type = CmdInResp
+	data := vin.EncodeToBytes(&SecurityKey{})
+
+	// No logger set should not panic.
+	if _, errs := DecodeBytes(data, &SecurityKey{}); len(errs) > 0 {
+		t.Fatalf("DecodeBytes() errors: %v", errs)
+	}
+
+	l := &testLogger{}
+	DecodeBytes(data, &SecurityKey{Logger: l})
+	want := "info: Read VIN from vehicle: JMFXDGG2WJZ00048 (Registrations: 2)"
+	found := false
+	for _, line := range l.lines {
+		if line == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("logger got=%q want line %q", l.lines, want)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := SlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	l.Tracef("trace %d", 1)
+	l.Debugf("debug %d", 2)
+	l.Infof("info %d", 3)
+
+	got := buf.String()
+	if strings.Contains(got, "trace 1") {
+		t.Errorf("trace logged above level: %s", got)
+	}
+	for _, want := range []string{`level=DEBUG msg="debug 2"`, `level=INFO msg="info 3"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output got=%s want %s", got, want)
+		}
+	}
+}
@@ -1,10 +1,11 @@
 package protocol
 
 import (
-	"encoding/binary"
+	"bytes"
 	"encoding/hex"
 	"fmt"
-	log "github.com/sirupsen/logrus"
+	"io"
+	"strings"
 	"time"
 )
 
@@ -132,15 +133,16 @@ func (p *PhevMessage) RawString() string {
 }
 
 func (p *PhevMessage) EncodeToBytes(key *SecurityKey) []byte {
-	length := byte(len(p.Data) + 3)
-	data := []byte{
-		p.Type,
-		length,
-		p.Ack,
-		p.Register,
-	}
-	data = append(data, p.Data...)
-	data = append(data, Checksum(data))
+	return p.AppendEncoded(make([]byte, 0, len(p.Data)+minFrameLength), key)
+}
+
+// AppendEncoded is as EncodeToBytes, appending the frame to dst and
+// returning the extended slice, so that a buffer may be reused.
+func (p *PhevMessage) AppendEncoded(dst []byte, key *SecurityKey) []byte {
+	start := len(dst)
+	dst = append(dst, p.Type, byte(len(p.Data)+3), p.Ack, p.Register)
+	dst = append(dst, p.Data...)
+	dst = append(dst, Checksum(dst[start:]))
 	var xor byte
 	switch p.Type {
 	case CmdInMy24StartReq, CmdOutMy24StartResp, CmdInMy18StartReq, CmdOutMy18StartResp, CmdInMy14StartReq, CmdOutMy14StartResp:
@@ -153,68 +155,74 @@ func (p *PhevMessage) EncodeToBytes(key *SecurityKey) []byte {
 		xor = key.SKey(false)
 	}
 	p.Xor = xor
-	return XorMessageWith(data, xor)
+	xorInto(dst[start:], dst[start:], xor)
+	return dst
 }
 
+// DecodeFromBytes decodes a single frame from data, updating key. An
+// *UnknownTypeError or *RegisterLengthError is returned with the
+// message otherwise fully decoded; other errors mean no message was
+// decoded. The message does not share memory with data.
 func (p *PhevMessage) DecodeFromBytes(data []byte, key *SecurityKey) error {
-	if len(data) < 4 {
-		return fmt.Errorf("invalid packet length")
+	if len(data) < minFrameLength {
+		return &ShortFrameError{Data: data}
+	}
+	length, xor, err := findFrame(data)
+	if err != nil {
+		return err
 	}
-	p.OriginalXored = data
-	data, xor, _ := ValidateAndDecodeMessage(data)
-	if len(data) < 4 || len(data) < int(data[1]+2) {
-		return fmt.Errorf("invalid packet length")
+	return p.decode(data, length, xor, make([]byte, 2*length), key)
+}
+
+// frameBuffer returns a buffer to decode a frame of length bytes into,
+// reusing the one from a previous decode if large enough.
+func (p *PhevMessage) frameBuffer(length int) []byte {
+	if cap(p.OriginalXored) >= 2*length {
+		return p.OriginalXored[:2*length]
 	}
+	return make([]byte, 2*length)
+}
+
+// decode decodes the valid frame of length bytes at the start of data,
+// XORed with xor. OriginalXored and Original are copied into buf, which
+// must be 2*length bytes, and the other slices refer to Original.
+func (p *PhevMessage) decode(data []byte, length int, xor byte, buf []byte, key *SecurityKey) error {
+	if length < minFrameLength {
+		return &ShortFrameError{Data: data[:length]}
+	}
+	// OriginalXored keeps the capacity of buf, for frameBuffer.
+	p.OriginalXored = buf[:length]
+	copy(p.OriginalXored, data)
+	p.Original = buf[length : 2*length : 2*length]
+	xorInto(p.Original, p.OriginalXored, xor)
+	data = p.Original
 	p.Type = data[0]
-	p.Length = data[1] + 2
+	p.Length = byte(length)
 	p.Register = data[3]
-	p.Data = data[4 : p.Length-1]
-	p.Checksum = data[p.Length-1]
+	p.Data = data[4 : length-1]
+	p.Checksum = data[length-1]
 	p.Ack = data[2]
 	p.Xor = xor
-	p.Original = data
+	p.Reg = nil
 	switch p.Type {
 	case CmdInMy24StartReq, CmdInMy18StartReq, CmdInMy14StartReq:
 		key.Update(p.OriginalXored)
+		key.setModelYear(modelYearFromStart(p.Type))
 	case CmdInResp:
 		key.RKey(true)
 	case CmdOutSend:
 		key.SKey(true)
 	}
+	if !frameTypes[p.Type] {
+		return &UnknownTypeError{Type: p.Type}
+	}
 	if p.Type == CmdInResp && p.Ack == Request {
-		switch p.Register {
-		case VINRegister:
-			p.Reg = new(RegisterVIN)
-		case SettingsRegister:
-			p.Reg = new(RegisterSettings)
-		case TimeRegister:
-			p.Reg = new(RegisterTime)
-		case ECUVersionRegister:
-			p.Reg = new(RegisterECUVersion)
-		case BatteryLevelRegister:
-			p.Reg = new(RegisterBatteryLevel)
-		case BatteryWarningRegister:
-			p.Reg = new(RegisterBatteryWarning)
-		case DoorStatusRegister:
-			p.Reg = new(RegisterDoorStatus)
-		case ChargePlugRegister:
-			p.Reg = new(RegisterChargePlug)
-		case ChargeStatusRegister:
-			p.Reg = new(RegisterChargeStatus)
-		case PreACStateRegister:
-			p.Reg = new(RegisterPreACState)
-		case ACOperStatusRegister:
-			p.Reg = new(RegisterACOperStatus)
-		case ACModeRegister:
-			p.Reg = new(RegisterACMode)
-		case WIFISSIDRegister:
-			p.Reg = new(RegisterWIFISSID)
-		case LightStatusRegister:
-			p.Reg = new(RegisterLightStatus)
-		default:
-			p.Reg = new(RegisterGeneric)
-		}
+		p.Reg = NewRegister(p.Register, key.ModelYear())
 		p.Reg.Decode(p)
+		if r, ok := p.Reg.(*RegisterVIN); ok && r.VIN != "" && key.Logger != nil {
+			key.Logger.Infof("Read VIN from vehicle: %s (Registrations: %d)", r.VIN, r.Registrations)
+		}
+		return checkRegisterLength(p, key.ModelYear())
 	}
 
 	return nil
@@ -226,38 +234,43 @@ func (p *PhevMessage) String() string {
 		p.Type, messageStr[p.Type], p.Length, p.Register, hex.EncodeToString(p.Data))
 }
 
+// NewFromBytes decodes all complete messages in data. A trailing
+// partial message is discarded; use a Decoder to read from a stream.
 func NewFromBytes(data []byte, key *SecurityKey) []*PhevMessage {
+	msgs, errs := DecodeBytes(data, key)
+	if key != nil && key.Logger != nil {
+		for _, err := range errs {
+			key.Logger.Debugf("decode error: %v", err)
+		}
+	}
+	return msgs
+}
+
+// DecodeBytes decodes all messages in data, also returning any errors
+// found along the way. Messages with an *UnknownTypeError or
+// *RegisterLengthError are still returned.
+func DecodeBytes(data []byte, key *SecurityKey) ([]*PhevMessage, []error) {
 	msgs := []*PhevMessage{}
+	errs := []error{}
 
-	log.Tracef("%%PHEV_DECODE_FROM_BYTES%%: Raw: %s", hex.EncodeToString(data))
-	offset := 0
+	if key != nil && key.Logger != nil {
+		key.Logger.Tracef("%%PHEV_DECODE_FROM_BYTES%%: Raw: %s", hexBytes(data))
+	}
+	d := NewDecoder(bytes.NewReader(data), key)
+	d.OnError = func(err error) {
+		errs = append(errs, err)
+	}
 	for {
-		dat, xor, rem := ValidateAndDecodeMessage(data[offset:])
-		if len(dat) == 0 {
-			offset += 1
-			if offset >= len(data)-6 {
-				break
-			}
-			continue
-		}
-		log.Tracef("%%PHEV_DECODED_FROM_BYTES%%: Raw: %s", hex.EncodeToString(dat))
-		dat = XorMessageWith(dat, xor)
-		p := &PhevMessage{}
-		err := p.DecodeFromBytes(dat, key)
-		p.OriginalXored = data[offset : offset+len(dat)]
-		p.Xor = xor
+		p, err := d.Decode()
 		if err != nil {
-			log.Errorf("decode error: %v\n", err)
+			if err != io.EOF {
+				errs = append(errs, err)
+			}
 			break
 		}
 		msgs = append(msgs, p)
-		if len(rem) < 1 {
-			break
-		}
-		data = rem
-		offset = 0
 	}
-	return msgs
+	return msgs, errs
 }
 
 func encodeTime(t time.Time) []byte {
@@ -283,24 +296,37 @@ func decodeTime(m []byte) time.Time {
 }
 
 const (
-	BatteryWarningRegister   = 0x02
-	SetACModeRegisterMY14    = 0x02
-	SetACEnabledRegisterMY14 = 0x04
-	PreACStateRegister       = 0x10
-	TimeRegister             = 0x12
-	SetAckPreACTermRegister  = 0x13
-	VINRegister              = 0x15
-	SettingsRegister         = 0x16
-	ACOperStatusRegister     = 0x1a
-	SetACModeRegisterMY18    = 0x1b
-	ACModeRegister           = 0x1c
-	BatteryLevelRegister     = 0x1d
-	ChargePlugRegister       = 0x1e
-	ChargeStatusRegister     = 0x1f
-	LightStatusRegister      = 0x23
-	DoorStatusRegister       = 0x24
-	WIFISSIDRegister         = 0x28
-	ECUVersionRegister       = 0xc0
+	BatteryWarningRegister       = 0x02
+	SetACModeRegisterMY14        = 0x02
+	SetACEnabledRegisterMY14     = 0x04
+	ChargeScheduleRegister       = 0x04
+	ClimateScheduleRegister      = 0x05
+	SetTimeRegister              = 0x05
+	SetRequestUpdateRegister     = 0x06
+	SetHeadlightsRegister        = 0x0a
+	SetParkingLightsRegister     = 0x0b
+	SaveSettingsRegister         = 0x0e
+	UpdateSettingsRegister       = 0x0f
+	PreACStateRegister           = 0x10
+	SetRegisterClientRegister    = 0x10
+	TimeRegister                 = 0x12
+	SetAckPreACTermRegister      = 0x13
+	VINRegister                  = 0x15
+	SetUnregisterClientRegister  = 0x15
+	SettingsRegister             = 0x16
+	SetCancelChargeTimerRegister = 0x17
+	ACOperStatusRegister         = 0x1a
+	SetClimateScheduleRegister   = 0x1a
+	SetChargeScheduleRegister    = 0x19
+	SetACModeRegisterMY18        = 0x1b
+	ACModeRegister               = 0x1c
+	BatteryLevelRegister         = 0x1d
+	ChargePlugRegister           = 0x1e
+	ChargeStatusRegister         = 0x1f
+	LightStatusRegister          = 0x23
+	DoorStatusRegister           = 0x24
+	WIFISSIDRegister             = 0x28
+	ECUVersionRegister           = 0xc0
 )
 
 type Register interface {
@@ -312,8 +338,8 @@ type Register interface {
 }
 
 type RegisterGeneric struct {
-	Reg   byte
-	Value []byte
+	Reg   byte   `json:"-"`
+	Value []byte `json:"-"`
 }
 
 func (r *RegisterGeneric) Decode(m *PhevMessage) {
@@ -341,7 +367,7 @@ func (r *RegisterGeneric) Register() byte {
 }
 
 type RegisterTime struct {
-	Time time.Time
+	Time time.Time `json:"time"`
 	raw  []byte
 }
 
@@ -360,6 +386,12 @@ func (r *RegisterTime) Encode() *PhevMessage {
 	}
 }
 
+// Drift returns how far the car clock is ahead of now, or behind if
+// negative, to the second.
+func (r *RegisterTime) Drift(now time.Time) time.Duration {
+	return r.Time.Sub(now).Round(time.Second)
+}
+
 func (r *RegisterTime) Raw() string {
 	return hex.EncodeToString(r.raw)
 }
@@ -373,6 +405,7 @@ func (r *RegisterTime) Register() byte {
 }
 
 type RegisterSettings struct {
+	Settings []Setting `json:"settings"`
 	register byte
 	raw      []byte
 }
@@ -380,6 +413,9 @@ type RegisterSettings struct {
 func (r *RegisterSettings) Decode(m *PhevMessage) {
 	r.register = m.Register
 	r.raw = m.Data
+	if validateSettingsRegister(m.Data) == nil {
+		r.Settings = decodeSettings(m.Data)
+	}
 }
 
 func (r *RegisterSettings) Encode() *PhevMessage {
@@ -394,8 +430,14 @@ func (r *RegisterSettings) Raw() string {
 }
 
 func (r *RegisterSettings) String() string {
-	value := binary.LittleEndian.Uint64(r.raw)
-	return fmt.Sprintf("Car Settings: %016x", value)
+	if len(r.Settings) == 0 {
+		return fmt.Sprintf("Car Settings: %s", hex.EncodeToString(r.raw))
+	}
+	settings := []string{}
+	for _, v := range r.Settings {
+		settings = append(settings, v.String())
+	}
+	return fmt.Sprintf("Car Settings: %s", strings.Join(settings, ", "))
 }
 
 func (r *RegisterSettings) Register() byte {
@@ -403,8 +445,8 @@ func (r *RegisterSettings) Register() byte {
 }
 
 type RegisterVIN struct {
-	VIN           string
-	Registrations int
+	VIN           string `json:"vin"`
+	Registrations int    `json:"registrations"`
 	raw           []byte
 }
 
@@ -415,14 +457,13 @@ func (r *RegisterVIN) Decode(m *PhevMessage) {
 	r.VIN = string(m.Data[1:17])
 	r.Registrations = int(m.Data[19])
 	r.raw = m.Data
-	log.Infof("Read VIN from vehicle: %s (Registrations: %d)", r.VIN, r.Registrations)
 }
 
 func (r *RegisterVIN) Encode() *PhevMessage {
-	data := []byte{0x3}
-	data = append(data, []byte(r.VIN)...)
-	data = append(data, 0x0)
-	data = append(data, byte(r.Registrations))
+	data := rawOr(r.raw, 20)
+	data[0] = 0x3
+	copy(data[1:17], append([]byte(r.VIN), make([]byte, 16)...))
+	data[19] = byte(r.Registrations)
 	return &PhevMessage{
 		Register: r.Register(),
 		Data:     data,
@@ -442,7 +483,7 @@ func (r *RegisterVIN) Register() byte {
 }
 
 type RegisterECUVersion struct {
-	Version string
+	Version string `json:"version"`
 	raw     []byte
 }
 
@@ -455,8 +496,11 @@ func (r *RegisterECUVersion) Decode(m *PhevMessage) {
 }
 
 func (r *RegisterECUVersion) Encode() *PhevMessage {
-	data := []byte(r.Version)
-	data = append(data, []byte{0x11, 0x00, 0x00}...)
+	data := rawOr(r.raw, 13)
+	if len(r.raw) != 13 {
+		data[10] = 0x11
+	}
+	copy(data[:9], append([]byte(r.Version), make([]byte, 9)...))
 	return &PhevMessage{
 		Register: r.Register(),
 		Data:     data,
@@ -476,8 +520,8 @@ func (r *RegisterECUVersion) Register() byte {
 }
 
 type RegisterBatteryLevel struct {
-	Level         int
-	ParkingLights bool // yes parking lights here.
+	Level         int  `json:"level"`
+	ParkingLights bool `json:"parking_lights"` // yes parking lights here.
 	raw           []byte
 }
 
@@ -491,7 +535,7 @@ func (r *RegisterBatteryLevel) Decode(m *PhevMessage) {
 }
 
 func (r *RegisterBatteryLevel) Encode() *PhevMessage {
-	data := []byte{byte(r.Level), 0x0, 0x0}
+	data := []byte{byte(r.Level), 0x0, 0x0, 0x0}
 	if r.ParkingLights {
 		data[2] = 0x1
 	}
@@ -515,7 +559,7 @@ func (r *RegisterBatteryLevel) Register() byte {
 }
 
 type RegisterBatteryWarning struct {
-	Warning int
+	Warning int `json:"warning"`
 	raw     []byte
 }
 
@@ -549,12 +593,16 @@ func (r *RegisterBatteryWarning) Register() byte {
 
 type RegisterDoorStatus struct {
 	// Locked is true if the vehicle is locked.
-	Locked bool
+	Locked bool `json:"locked"`
 	// The below are true if the corresponding door is open.
-	Driver, FrontPassenger, RearLeft, RearRight bool
-	Bonnet, Boot                                bool
+	Driver         bool `json:"driver"`
+	FrontPassenger bool `json:"front_passenger"`
+	RearLeft       bool `json:"rear_left"`
+	RearRight      bool `json:"rear_right"`
+	Bonnet         bool `json:"bonnet"`
+	Boot           bool `json:"boot"`
 	// Headlight state is in this register!
-	Headlights bool
+	Headlights bool `json:"headlights"`
 	raw        []byte
 }
 
@@ -644,8 +692,8 @@ func (r *RegisterDoorStatus) Register() byte {
 }
 
 type RegisterChargeStatus struct {
-	Charging  bool
-	Remaining int // minutes.
+	Charging  bool `json:"charging"`
+	Remaining int  `json:"remaining"` // minutes.
 	raw       []byte
 }
 
@@ -675,7 +723,14 @@ func (r *RegisterChargeStatus) Encode() *PhevMessage {
 }
 
 func (r *RegisterACOperStatus) Encode() *PhevMessage {
-	data := make([]byte, 5)
+	// MY'14 sends 2 bytes, later years 5, so keep the decoded length.
+	n := 5
+	if len(r.raw) >= 2 {
+		n = len(r.raw)
+	}
+	data := rawOr(r.raw, n)
+	data[0] = byte(r.Ignition)
+	data[1] = 0x0
 	if r.Operating {
 		data[1] = 0x1
 	}
@@ -708,14 +763,36 @@ const (
 	PreACTerminated PreACState = 3
 )
 
+func (s PreACState) String() string {
+	switch s {
+	case PreACOff:
+		return "off"
+	case PreACOn:
+		return "on"
+	case PreACTerminated:
+		return "terminated"
+	default:
+		return fmt.Sprintf("%d", int8(s))
+	}
+}
+
 type RegisterPreACState struct {
-	State PreACState
+	State PreACState `json:"state"`
 	raw   []byte
 }
 
 func (r *RegisterPreACState) Encode() *PhevMessage {
-	panic("unimplemented")
-	return nil
+	// MY'14 sends a single byte, so keep that layout if it was decoded
+	// from one. Otherwise use the MY'18 layout, keeping unknown bytes.
+	data := rawOr(r.raw, 3)
+	if len(r.raw) == 1 {
+		data = []byte{0x0}
+	}
+	data[0] = byte(r.State)
+	return &PhevMessage{
+		Register: r.Register(),
+		Data:     data,
+	}
 }
 
 func (r *RegisterPreACState) Decode(m *PhevMessage) {
@@ -749,17 +826,40 @@ func (r *RegisterPreACState) Register() byte {
 	return PreACStateRegister
 }
 
+type IgnitionState byte
+
+const (
+	IgnitionOff       IgnitionState = 0
+	IgnitionAccessory IgnitionState = 3
+	IgnitionOn        IgnitionState = 4
+)
+
+func (i IgnitionState) String() string {
+	switch i {
+	case IgnitionOff:
+		return "off"
+	case IgnitionAccessory:
+		return "accessory"
+	case IgnitionOn:
+		return "on"
+	default:
+		return fmt.Sprintf("unknown (%d)", byte(i))
+	}
+}
+
 type RegisterACOperStatus struct {
-	Operating bool
+	Ignition  IgnitionState `json:"ignition"`
+	Operating bool          `json:"operating"`
 	raw       []byte
 }
 
 func (r *RegisterACOperStatus) Decode(m *PhevMessage) {
 	// MY'18 data length is 5 bytes, MY'14 uses 2 bytes
-	// We only decode the operating state in byte 2
+	// Byte 0 is the ignition state, byte 1 the AC operating state.
 	if m.Register != ACOperStatusRegister || len(m.Data) < 2 {
 		return
 	}
+	r.Ignition = IgnitionState(m.Data[0])
 	r.Operating = m.Data[1] == 1
 	r.raw = m.Data
 }
@@ -770,9 +870,9 @@ func (r *RegisterACOperStatus) Raw() string {
 
 func (r *RegisterACOperStatus) String() string {
 	if r.Operating {
-		return "AC on"
+		return fmt.Sprintf("AC on, ignition %s", r.Ignition)
 	}
-	return "AC off"
+	return fmt.Sprintf("AC off, ignition %s", r.Ignition)
 }
 
 func (r *RegisterACOperStatus) Register() byte {
@@ -780,8 +880,8 @@ func (r *RegisterACOperStatus) Register() byte {
 }
 
 type RegisterACMode struct {
-	Mode     string
-	Duration uint8
+	Mode     string `json:"mode"`
+	Duration uint8  `json:"duration"`
 	raw      []byte
 }
 
@@ -822,6 +922,12 @@ func (r *RegisterACMode) Encode() *PhevMessage {
 	case "windscreen":
 		data = 0x3
 	}
+	switch r.Duration {
+	case 20:
+		data |= 0x10
+	case 30:
+		data |= 0x20
+	}
 	return &PhevMessage{
 		Register: r.Register(),
 		Data:     []byte{data},
@@ -841,7 +947,7 @@ func (r *RegisterACMode) Register() byte {
 }
 
 type RegisterChargePlug struct {
-	Connected bool
+	Connected bool `json:"connected"`
 	raw       []byte
 }
 
@@ -880,7 +986,7 @@ func (r *RegisterChargePlug) Register() byte {
 }
 
 type RegisterWIFISSID struct {
-	SSID string
+	SSID string `json:"ssid"`
 	raw  []byte
 }
 
@@ -920,6 +1026,17 @@ func (r *RegisterWIFISSID) Register() byte {
 	return WIFISSIDRegister
 }
 
+// rawOr returns a copy of raw if it is n bytes long, so that unknown
+// bytes are kept when re-encoding a decoded register. Otherwise it
+// returns n zero bytes.
+func rawOr(raw []byte, n int) []byte {
+	data := make([]byte, n)
+	if len(raw) == n {
+		copy(data, raw)
+	}
+	return data
+}
+
 func NewPingRequestMessage(id byte) *PhevMessage {
 	return NewMessage(CmdOutPingReq, id, false, []byte{0x0})
 }
@@ -941,14 +1058,24 @@ func NewMessage(typ, register byte, ack bool, data []byte) *PhevMessage {
 }
 
 type RegisterLightStatus struct {
-	Interior bool
-	Hazard   bool
+	Interior bool `json:"interior"`
+	Hazard   bool `json:"hazard"`
 	raw      []byte
 }
 
 func (r *RegisterLightStatus) Encode() *PhevMessage {
-	panic("unimplemented")
-	return nil
+	data := rawOr(r.raw, 5)
+	data[3], data[4] = 0x2, 0x2
+	if r.Hazard {
+		data[3] = 0x1
+	}
+	if r.Interior {
+		data[4] = 0x1
+	}
+	return &PhevMessage{
+		Register: r.Register(),
+		Data:     data,
+	}
 }
 
 func (r *RegisterLightStatus) Decode(m *PhevMessage) {
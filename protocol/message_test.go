@@ -2,8 +2,13 @@ package protocol
 
 import (
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"gopkg.in/d4l3k/messagediff.v1"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDecodeEncodeBytes(t *testing.T) {
@@ -117,3 +122,294 @@ func TestDecodeEncodeBytes(t *testing.T) {
 		})
 	}
 }
+
+func TestClimateSchedule(t *testing.T) {
+	tests := []struct {
+		in     string
+		timers [5]ClimateTimer
+		set    string
+	}{
+		{
+			in:  "0100fe0700fe0700fe0700fe0700fe07",
+			set: "00fe0700fe0700fe0700fe0700fe0701",
+		}, {
+			in: "0204c00200fe0700fe0700fe0700fe07",
+			timers: [5]ClimateTimer{
+				{InUse: true, Enabled: true, Hour: 12, Minute: 0, Duration: 10, Days: 1 << time.Sunday},
+			},
+			set: "04c00200fe0700fe0700fe0700fe0701",
+		}, {
+			in: "0204c0021d7a0200fe0700fe0700fe07",
+			timers: [5]ClimateTimer{
+				{InUse: true, Enabled: true, Hour: 12, Minute: 0, Duration: 10, Days: 1 << time.Sunday},
+				{InUse: true, Enabled: true, Hour: 7, Minute: 50, Duration: 20, Days: 1<<time.Sunday | 1<<time.Monday | 1<<time.Tuesday},
+			},
+			set: "04c0021d7a0200fe0700fe0700fe0701",
+		}, {
+			in: "0204c0041d7a0400fe0700fe0700fe07",
+			timers: [5]ClimateTimer{
+				{InUse: true, Hour: 12, Minute: 0, Duration: 10, Days: 1 << time.Sunday},
+				{InUse: true, Hour: 7, Minute: 50, Duration: 20, Days: 1<<time.Sunday | 1<<time.Monday | 1<<time.Tuesday},
+			},
+			set: "04c0041d7a0400fe0700fe0700fe0701",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			data, err := hex.DecodeString(test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &RegisterClimateSchedule{}
+			r.Decode(&PhevMessage{Register: ClimateScheduleRegister, Data: data})
+			if diff, eq := messagediff.PrettyDiff(test.timers, r.Timers); !eq {
+				t.Fatalf("Decode() diff=%s", diff)
+			}
+			if got := hex.EncodeToString(r.Encode().Data); got != test.in {
+				t.Errorf("Encode() got=%s want=%s", got, test.in)
+			}
+			msg, err := r.EncodeSet()
+			if err != nil {
+				t.Fatalf("EncodeSet() unexpected error: %v", err)
+			}
+			if msg.Register != SetClimateScheduleRegister {
+				t.Errorf("EncodeSet() register got=0x%02x want=0x%02x", msg.Register, SetClimateScheduleRegister)
+			}
+			if got := hex.EncodeToString(msg.Data); got != test.set {
+				t.Errorf("EncodeSet() got=%s want=%s", got, test.set)
+			}
+		})
+	}
+}
+
+func TestClimateScheduleInvalid(t *testing.T) {
+	r := &RegisterClimateSchedule{}
+	r.Timers[2] = ClimateTimer{InUse: true, Hour: 7, Minute: 15, Duration: 10}
+	if _, err := r.EncodeSet(); err == nil {
+		t.Fatalf("EncodeSet() expected error for minute 15")
+	}
+}
+
+func TestChargeSchedule(t *testing.T) {
+	tests := []struct {
+		in     string
+		timers [5]ChargeTimer
+		set    string
+	}{
+		{
+			in: "7d38b00183bd00017c70380100ffff0300ffff03",
+			timers: [5]ChargeTimer{
+				{InUse: true, Enabled: true, Days: 0x7d, StartHour: 22, EndHour: 7},
+				{InUse: true, Enabled: true, Days: 0x03, StartHour: 0, EndHour: 23, EndMinute: 50, flag: true},
+				{InUse: true, Enabled: true, Days: 0x7c, StartHour: 7, EndHour: 14},
+			},
+			set: "7d38b00183bd00017c70380100ffff0300ffff0302",
+		}, {
+			in: "7d38b00183bd00017c70380200ffff0300ffff03",
+			timers: [5]ChargeTimer{
+				{InUse: true, Enabled: true, Days: 0x7d, StartHour: 22, EndHour: 7},
+				{InUse: true, Enabled: true, Days: 0x03, StartHour: 0, EndHour: 23, EndMinute: 50, flag: true},
+				{InUse: true, Days: 0x7c, StartHour: 7, EndHour: 14},
+			},
+			set: "7d38b00183bd00017c70380200ffff0300ffff0302",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			data, err := hex.DecodeString(test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &RegisterChargeSchedule{}
+			r.Decode(&PhevMessage{Register: ChargeScheduleRegister, Data: data})
+			if diff, eq := messagediff.PrettyDiff(test.timers, r.Timers); !eq {
+				t.Fatalf("Decode() diff=%s", diff)
+			}
+			if got := hex.EncodeToString(r.Encode().Data); got != test.in {
+				t.Errorf("Encode() got=%s want=%s", got, test.in)
+			}
+			msg, err := r.EncodeSet()
+			if err != nil {
+				t.Fatalf("EncodeSet() unexpected error: %v", err)
+			}
+			if msg.Register != SetChargeScheduleRegister {
+				t.Errorf("EncodeSet() register got=0x%02x want=0x%02x", msg.Register, SetChargeScheduleRegister)
+			}
+			if got := hex.EncodeToString(msg.Data); got != test.set {
+				t.Errorf("EncodeSet() got=%s want=%s", got, test.set)
+			}
+		})
+	}
+}
+
+func TestACOperStatusIgnition(t *testing.T) {
+	tests := []struct {
+		in        string
+		ignition  IgnitionState
+		operating bool
+	}{
+		{"0001000000", IgnitionOff, true},
+		{"0300000000", IgnitionAccessory, false},
+		{"0401000000", IgnitionOn, true},
+		{"0400", IgnitionOn, false},
+		{"c800", IgnitionState(0xc8), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			data, err := hex.DecodeString(test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &RegisterACOperStatus{}
+			r.Decode(&PhevMessage{Register: ACOperStatusRegister, Data: data})
+			if r.Ignition != test.ignition {
+				t.Errorf("Ignition got=%s want=%s", r.Ignition, test.ignition)
+			}
+			if r.Operating != test.operating {
+				t.Errorf("Operating got=%v want=%v", r.Operating, test.operating)
+			}
+		})
+	}
+	if got, want := IgnitionState(0xc8).String(), "unknown (200)"; got != want {
+		t.Errorf("String() got=%s want=%s", got, want)
+	}
+}
+
+type testRegister struct {
+	RegisterGeneric
+	year ModelYear
+}
+
+func TestDecoderRegistry(t *testing.T) {
+	const reg = 0x99
+	RegisterDecoder(reg, func() Register { return &testRegister{} })
+	RegisterModelDecoder(reg, ModelYear18, func() Register { return &testRegister{year: ModelYear18} })
+	defer UnregisterDecoder(reg, ModelYearUnknown)
+	defer UnregisterDecoder(reg, ModelYear18)
+
+	tests := []struct {
+		year ModelYear
+		want ModelYear
+	}{
+		{ModelYearUnknown, ModelYearUnknown},
+		{ModelYear14, ModelYearUnknown},
+		{ModelYear18, ModelYear18},
+	}
+	for _, test := range tests {
+		key := &SecurityKey{modelYear: test.year}
+		msg := NewMessage(CmdInResp, reg, false, []byte{0x1, 0x2})
+		p := &PhevMessage{}
+		if err := p.DecodeFromBytes(msg.EncodeToBytes(&SecurityKey{}), key); err != nil {
+			t.Fatal(err)
+		}
+		r, ok := p.Reg.(*testRegister)
+		if !ok {
+			t.Fatalf("%s: got register %T, want *testRegister", test.year, p.Reg)
+		}
+		if r.year != test.want {
+			t.Errorf("%s: got decoder for %s, want %s", test.year, r.year, test.want)
+		}
+	}
+
+	UnregisterDecoder(reg, ModelYear18)
+	UnregisterDecoder(reg, ModelYearUnknown)
+	if r := NewRegister(reg, ModelYear18); reflect.TypeOf(r) != reflect.TypeOf(&RegisterGeneric{}) {
+		t.Errorf("after unregister got %T, want *RegisterGeneric", r)
+	}
+}
+
+func TestRegisterRoundTrip(t *testing.T) {
+	tests := []struct {
+		reg      Register
+		register byte
+		data     string
+	}{
+		{new(RegisterGeneric), 0x99, "0102"},
+		{new(RegisterVIN), VINRegister, "034a4d465844474732574a5a3030303438010002"},
+		{new(RegisterSettings), SettingsRegister, "026b0e2c002d0000"},
+		{new(RegisterTime), TimeRegister, "160a0712391805"},
+		{new(RegisterECUVersion), ECUVersionRegister, "30303532303232303030110000"},
+		{new(RegisterBatteryLevel), BatteryLevelRegister, "50000100"},
+		{new(RegisterBatteryWarning), BatteryWarningRegister, "00000100"},
+		{new(RegisterDoorStatus), DoorStatusRegister, "01000001000100010001"},
+		{new(RegisterChargePlug), ChargePlugRegister, "0001"},
+		{new(RegisterChargeStatus), ChargeStatusRegister, "015a00"},
+		{new(RegisterPreACState), PreACStateRegister, "02b00b"},
+		{new(RegisterPreACState), PreACStateRegister, "03"},
+		{new(RegisterACOperStatus), ACOperStatusRegister, "0401000000"},
+		{new(RegisterACOperStatus), ACOperStatusRegister, "0400"},
+		{new(RegisterACMode), ACModeRegister, "12"},
+		{new(RegisterWIFISSID), WIFISSIDRegister, "52454d4f54456330666665650000000000000000000000000000000000000000"},
+		{new(RegisterLightStatus), LightStatusRegister, "0101000102"},
+		{new(RegisterClimateSchedule), ClimateScheduleRegister, "0204c0021d7a0200fe0700fe0700fe07"},
+		{new(RegisterChargeSchedule), ChargeScheduleRegister, "7d38b00183bd00017c70380100ffff0300ffff03"},
+	}
+
+	covered := map[reflect.Type]bool{}
+	for _, test := range tests {
+		covered[reflect.TypeOf(test.reg)] = true
+		t.Run(reflect.TypeOf(test.reg).Elem().Name()+"/"+test.data, func(t *testing.T) {
+			data, err := hex.DecodeString(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.reg.Decode(&PhevMessage{Register: test.register, Data: data})
+			msg := test.reg.Encode()
+			if msg.Register != test.register {
+				t.Errorf("Encode() register got=0x%02x want=0x%02x", msg.Register, test.register)
+			}
+			if diff := hexCmp(msg.Data, test.data); diff != "" {
+				t.Errorf("Encode() %s", diff)
+			}
+			again := reflect.New(reflect.TypeOf(test.reg).Elem()).Interface().(Register)
+			again.Decode(msg)
+			if diff, eq := messagediff.PrettyDiff(test.reg, again); !eq {
+				t.Errorf("Decode(Encode()) diff=%s", diff)
+			}
+			b, err := json.Marshal(test.reg)
+			if err != nil {
+				t.Fatalf("MarshalJSON(): %v", err)
+			}
+			if want := fmt.Sprintf(`"register":"0x%02x"`, test.register); !strings.Contains(string(b), want) {
+				t.Errorf("MarshalJSON() got=%s, missing %s", b, want)
+			}
+		})
+	}
+
+	// Every built in register type must be covered above.
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for k, f := range registry {
+		if typ := reflect.TypeOf(f()); !covered[typ] {
+			t.Errorf("register 0x%02x type %s has no round trip test", k.register, typ)
+		}
+	}
+}
+
+func BenchmarkAppendEncoded(b *testing.B) {
+	key := &SecurityKey{}
+	key.setKey(0x45)
+	m := &PhevMessage{
+		Type:     CmdOutSend,
+		Register: SetHeadlightsRegister,
+		Ack:      Request,
+		Data:     []byte{0x1},
+	}
+	var buf []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = m.AppendEncoded(buf[:0], key)
+	}
+}
+
+func TestRegisterTimeDrift(t *testing.T) {
+	r := &RegisterTime{}
+	r.Decode(&PhevMessage{Register: TimeRegister, Data: []byte{24, 3, 9, 13, 45, 10, 6}})
+	now := time.Date(2024, time.March, 9, 13, 47, 0, 400*int(time.Millisecond), time.Local)
+	if got, want := r.Drift(now), -110*time.Second; got != want {
+		t.Errorf("Drift() got=%v want=%v", got, want)
+	}
+}
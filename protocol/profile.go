@@ -0,0 +1,231 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ClimateMode is the pre-conditioning mode.
+type ClimateMode byte
+
+const (
+	ClimateOff        ClimateMode = 0x0
+	ClimateCool       ClimateMode = 0x1
+	ClimateHeat       ClimateMode = 0x2
+	ClimateWindscreen ClimateMode = 0x3
+)
+
+func (m ClimateMode) String() string {
+	switch m {
+	case ClimateOff:
+		return "off"
+	case ClimateCool:
+		return "cool"
+	case ClimateHeat:
+		return "heat"
+	case ClimateWindscreen:
+		return "windscreen"
+	default:
+		return fmt.Sprintf("unknown (%d)", byte(m))
+	}
+}
+
+// climateDuration returns the encoded run time, 0=10min 1=20min 2=30min.
+func climateDuration(minutes int) (byte, error) {
+	switch minutes {
+	case 10, 20, 30:
+		return byte(minutes/10 - 1), nil
+	}
+	return 0, fmt.Errorf("climate duration must be 10, 20 or 30 minutes: %d", minutes)
+}
+
+// climateDelay returns the encoded delay before starting, 0=now
+// 1=5min 2=10min.
+func climateDelay(minutes int) (byte, error) {
+	switch minutes {
+	case 0, 5, 10:
+		return byte(minutes / 5), nil
+	}
+	return 0, fmt.Errorf("climate delay must be 0, 5 or 10 minutes: %d", minutes)
+}
+
+// A Profile describes how a model year lays out its registers and
+// encodes commands.
+type Profile struct {
+	ModelYear ModelYear
+	// ClimateRegister is written to set the climate mode.
+	ClimateRegister byte
+	// ClimateEnableRegister, if non-zero, is written after
+	// ClimateRegister to switch climate on or off.
+	ClimateEnableRegister byte
+	// Registers written for other commands, the same on all years.
+	HeadlightsRegister        byte
+	ParkingLightsRegister     byte
+	CancelChargeTimerRegister byte
+	PreACResetRegister        byte
+	RequestUpdateRegister     byte
+
+	// Data lengths of registers which differ between model years.
+	registerLengths map[byte]int
+	climate         func(p *Profile, mode ClimateMode, duration, delay byte) []*PhevMessage
+	// climateDelay is whether the climate may be started after a delay.
+	climateDelay bool
+}
+
+// RegisterLength returns the data length of register as sent by this
+// model year, or 0 if it is not known to vary.
+func (p *Profile) RegisterLength(register byte) int {
+	return p.registerLengths[register]
+}
+
+// ClimateCommands returns the messages to set the climate mode, running
+// for the given number of minutes (10, 20 or 30). The duration is
+// ignored when mode is ClimateOff.
+func (p *Profile) ClimateCommands(mode ClimateMode, minutes int) ([]*PhevMessage, error) {
+	return p.ClimateDelayCommands(mode, minutes, 0)
+}
+
+// ClimateDelayCommands is as ClimateCommands, starting after a delay of
+// 0, 5 or 10 minutes. MY'14 does not support a delay.
+func (p *Profile) ClimateDelayCommands(mode ClimateMode, minutes, delay int) ([]*PhevMessage, error) {
+	if p.climate == nil {
+		return nil, fmt.Errorf("climate control not supported for model year %s", p.ModelYear)
+	}
+	if mode > ClimateWindscreen {
+		return nil, fmt.Errorf("invalid climate mode: %s", mode)
+	}
+	var duration, start byte
+	if mode != ClimateOff {
+		var err error
+		if duration, err = climateDuration(minutes); err != nil {
+			return nil, err
+		}
+		if delay != 0 && !p.climateDelay {
+			return nil, fmt.Errorf("climate delay not supported for model year %s", p.ModelYear)
+		}
+		if start, err = climateDelay(delay); err != nil {
+			return nil, err
+		}
+	}
+	return p.climate(p, mode, duration, start), nil
+}
+
+// HeadlightsCommand returns the message to switch the headlights.
+func (p *Profile) HeadlightsCommand(on bool) *PhevMessage {
+	return NewMessage(CmdOutSend, p.HeadlightsRegister, false, []byte{lightState(on)})
+}
+
+// ParkingLightsCommand returns the message to switch the parking lights.
+func (p *Profile) ParkingLightsCommand(on bool) *PhevMessage {
+	return NewMessage(CmdOutSend, p.ParkingLightsRegister, false, []byte{lightState(on)})
+}
+
+// CancelChargeTimerCommands returns the messages to cancel the charge
+// timer, so charging starts immediately.
+func (p *Profile) CancelChargeTimerCommands() []*PhevMessage {
+	return []*PhevMessage{
+		NewMessage(CmdOutSend, p.CancelChargeTimerRegister, false, []byte{0x1}),
+		NewMessage(CmdOutSend, p.CancelChargeTimerRegister, false, []byte{0x11}),
+	}
+}
+
+// PreACResetCommand returns the message to acknowledge a terminated
+// pre-conditioning.
+func (p *Profile) PreACResetCommand() *PhevMessage {
+	return NewMessage(CmdOutSend, p.PreACResetRegister, false, []byte{0x1})
+}
+
+// RequestUpdateCommand returns the message asking the car to resend
+// all registers.
+func (p *Profile) RequestUpdateCommand() *PhevMessage {
+	return NewMessage(CmdOutSend, p.RequestUpdateRegister, false, []byte{0x3})
+}
+
+func lightState(on bool) byte {
+	if on {
+		return 0x1
+	}
+	return 0x2
+}
+
+// MY'14 takes a 15 byte mode register padded with 0xff, then a
+// separate register to switch on or off.
+func climateMY14(p *Profile, mode ClimateMode, duration, _ byte) []*PhevMessage {
+	data := bytes.Repeat([]byte{0xff}, 15)
+	data[0] = 0x0
+	data[1] = 0x0
+	data[6] = byte(mode) | duration
+	enable := byte(0x02)
+	if mode == ClimateOff {
+		enable = 0x01
+	}
+	return []*PhevMessage{
+		NewMessage(CmdOutSend, p.ClimateRegister, false, data),
+		NewMessage(CmdOutSend, p.ClimateEnableRegister, false, []byte{enable}),
+	}
+}
+
+// MY'18 onwards sets state, mode, duration and delay in a single
+// register.
+func climateMY18(p *Profile, mode ClimateMode, duration, delay byte) []*PhevMessage {
+	state := byte(0x02)
+	if mode == ClimateOff {
+		state = 0x01
+	}
+	return []*PhevMessage{
+		NewMessage(CmdOutSend, p.ClimateRegister, false, []byte{state, byte(mode), duration, delay}),
+	}
+}
+
+func newProfile(year ModelYear) *Profile {
+	return &Profile{
+		ModelYear:                 year,
+		HeadlightsRegister:        SetHeadlightsRegister,
+		ParkingLightsRegister:     SetParkingLightsRegister,
+		CancelChargeTimerRegister: SetCancelChargeTimerRegister,
+		PreACResetRegister:        SetAckPreACTermRegister,
+		RequestUpdateRegister:     SetRequestUpdateRegister,
+		registerLengths:           map[byte]int{},
+	}
+}
+
+var profiles = map[ModelYear]*Profile{}
+
+func init() {
+	my14 := newProfile(ModelYear14)
+	my14.ClimateRegister = SetACModeRegisterMY14
+	my14.ClimateEnableRegister = SetACEnabledRegisterMY14
+	my14.climate = climateMY14
+	my14.registerLengths = map[byte]int{
+		PreACStateRegister:      1,
+		ACOperStatusRegister:    2,
+		ClimateScheduleRegister: 1,
+		ChargeScheduleRegister:  1,
+	}
+	profiles[ModelYear14] = my14
+
+	// MY'24 is not known to differ from MY'18.
+	for _, year := range []ModelYear{ModelYear18, ModelYear24} {
+		p := newProfile(year)
+		p.ClimateRegister = SetACModeRegisterMY18
+		p.climate = climateMY18
+		p.climateDelay = true
+		p.registerLengths = map[byte]int{
+			PreACStateRegister:      3,
+			ACOperStatusRegister:    5,
+			ClimateScheduleRegister: 16,
+			ChargeScheduleRegister:  20,
+		}
+		profiles[year] = p
+	}
+	profiles[ModelYearUnknown] = newProfile(ModelYearUnknown)
+}
+
+// ProfileFor returns the profile for a model year. The profile for an
+// unknown model year supports only commands common to all years.
+func ProfileFor(year ModelYear) *Profile {
+	if p, ok := profiles[year]; ok {
+		return p
+	}
+	return profiles[ModelYearUnknown]
+}
@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestProfileClimateCommands(t *testing.T) {
+	tests := []struct {
+		year    ModelYear
+		mode    ClimateMode
+		minutes int
+		want    []string
+	}{
+		{ModelYear18, ClimateHeat, 20, []string{"1b:02020100"}},
+		{ModelYear24, ClimateWindscreen, 10, []string{"1b:02030000"}},
+		{ModelYear18, ClimateOff, 0, []string{"1b:01000000"}},
+		{ModelYear14, ClimateCool, 30, []string{"02:0000ffffffff03ffffffffffffffff", "04:02"}},
+		{ModelYear14, ClimateOff, 0, []string{"02:0000ffffffff00ffffffffffffffff", "04:01"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.year.String()+"/"+test.mode.String(), func(t *testing.T) {
+			msgs, err := ProfileFor(test.year).ClimateCommands(test.mode, test.minutes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgs) != len(test.want) {
+				t.Fatalf("got %d messages, want %d", len(msgs), len(test.want))
+			}
+			for i, m := range msgs {
+				got := hex.EncodeToString([]byte{m.Register}) + ":" + hex.EncodeToString(m.Data)
+				if got != test.want[i] {
+					t.Errorf("message %d got=%s want=%s", i, got, test.want[i])
+				}
+				if m.Type != CmdOutSend {
+					t.Errorf("message %d type got=0x%02x want=0x%02x", i, m.Type, CmdOutSend)
+				}
+			}
+		})
+	}
+}
+
+func TestProfileClimateDelayCommands(t *testing.T) {
+	msgs, err := ProfileFor(ModelYear18).ClimateDelayCommands(ClimateCool, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := hexCmp(msgs[0].Data, "02010002"); diff != "" {
+		t.Errorf("MY18 delay %s", diff)
+	}
+	if _, err := ProfileFor(ModelYear14).ClimateDelayCommands(ClimateCool, 10, 5); err == nil {
+		t.Error("MY14 delay, want error")
+	}
+	if _, err := ProfileFor(ModelYear14).ClimateDelayCommands(ClimateOff, 0, 5); err != nil {
+		t.Errorf("MY14 off with delay: %v", err)
+	}
+}
+
+func TestProfileClimateInvalid(t *testing.T) {
+	if _, err := ProfileFor(ModelYearUnknown).ClimateCommands(ClimateHeat, 10); err == nil {
+		t.Error("unknown model year, want error")
+	}
+	if _, err := ProfileFor(ModelYear18).ClimateCommands(ClimateHeat, 15); err == nil {
+		t.Error("invalid duration, want error")
+	}
+	if _, err := ProfileFor(ModelYear18).ClimateDelayCommands(ClimateHeat, 10, 3); err == nil {
+		t.Error("invalid delay, want error")
+	}
+	if _, err := ProfileFor(ModelYear18).ClimateCommands(ClimateMode(0x4), 10); err == nil {
+		t.Error("invalid mode, want error")
+	}
+}
+
+func TestProfileRegisterLength(t *testing.T) {
+	if got := ProfileFor(ModelYear14).RegisterLength(PreACStateRegister); got != 1 {
+		t.Errorf("MY14 pre-AC length got=%d want=1", got)
+	}
+	if got := ProfileFor(ModelYear18).RegisterLength(PreACStateRegister); got != 3 {
+		t.Errorf("MY18 pre-AC length got=%d want=3", got)
+	}
+	if got := ProfileFor(ModelYear18).RegisterLength(VINRegister); got != 0 {
+		t.Errorf("MY18 VIN length got=%d want=0", got)
+	}
+}
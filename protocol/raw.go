@@ -1,9 +1,8 @@
 package protocol
 
 import (
-	"encoding/hex"
-	log "github.com/sirupsen/logrus"
 	"math/rand"
+	"sync"
 )
 
 type SecurityState int
@@ -15,16 +14,38 @@ const (
 )
 
 // SecurityKey implements the algorithm for the session encoding/decoding
-// keys.
+// keys. It is safe for concurrent use, as messages are decoded and
+// encoded on different goroutines.
 type SecurityKey struct {
+	mu          sync.Mutex
 	State       SecurityState
 	proposedKey []byte
 	securityKey byte
 	keyMap      []byte
 	sNum, rNum  byte
+	modelYear   ModelYear
+
+	// Logger, if set, receives debug output for the session.
+	Logger Logger
+}
+
+// ModelYear returns the model year announced by the car when the
+// session started, used to select register decoders.
+func (s *SecurityKey) ModelYear() ModelYear {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.modelYear
+}
+
+func (s *SecurityKey) setModelYear(year ModelYear) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modelYear = year
 }
 
 func (s *SecurityKey) GenerateProposal() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.proposedKey = make([]byte, 8)
 	for i := 0; i < 8; i++ {
 		s.proposedKey[i] = byte(rand.Intn(256))
@@ -34,7 +55,9 @@ func (s *SecurityKey) GenerateProposal() []byte {
 }
 
 func (s *SecurityKey) AcceptProposal() {
-	s.Update(append([]byte{0x0, 0x0, 0x0, 0x0}, s.proposedKey...))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update(append([]byte{0x0, 0x0, 0x0, 0x0}, s.proposedKey...))
 	s.State = SecurityKeyAccepted
 }
 
@@ -44,12 +67,20 @@ func (s *SecurityKey) AcceptProposal() {
 // then from this security key a key map is generated, essentially
 // an array of session keys which are rotated through.
 func (s *SecurityKey) Update(packet []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update(packet)
+}
+
+func (s *SecurityKey) update(packet []byte) {
 	if len(packet) < 12 {
 		s.keyMap = []byte{} // Clear security keys.
 		s.securityKey = 0x0
 		s.sNum = 0
 		s.rNum = 0
-		log.Debugf("%%PHEV_SEC_KEY_CLEAR%% Cleared security key")
+		if s.Logger != nil {
+			s.Logger.Debugf("%%PHEV_SEC_KEY_CLEAR%% Cleared security key")
+		}
 		return
 	}
 	// Calculate security key from provided packet.
@@ -61,7 +92,16 @@ func (s *SecurityKey) Update(packet []byte) {
 	result |= (packet[9] & 0x8) << 2
 	result |= (packet[10] & 0x8) << 3
 	result |= (packet[11] & 0x8) << 4
-	s.securityKey = byte(result)
+	s.setKey(byte(result))
+	if s.Logger != nil {
+		s.Logger.Debugf("%%PHEV_SEC_KEY_UPDATE%% Updated security key")
+	}
+}
+
+// setKey generates the key map from the security key, and resets the
+// send/receive indices.
+func (s *SecurityKey) setKey(key byte) {
+	s.securityKey = key
 	// From this key, generate the key map.
 	s_key := int(s.securityKey)
 	s.keyMap = make([]byte, 256)
@@ -81,7 +121,6 @@ func (s *SecurityKey) Update(packet []byte) {
 	// Reset the keymap send/receive indices.
 	s.sNum = 0
 	s.rNum = 0
-	log.Debugf("%%PHEV_SEC_KEY_UPDATE%% Updated security key")
 }
 
 // Fetch and optionally increment the index for the received
@@ -91,15 +130,21 @@ func (s *SecurityKey) Update(packet []byte) {
 // The returned value is XORed with the raw packet from the car before
 // decoding it.
 func (s *SecurityKey) RKey(increment bool) byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if len(s.keyMap) == 0 {
-		log.Tracef("r_key=empty")
+		if s.Logger != nil {
+			s.Logger.Tracef("r_key=empty")
+		}
 		return 0
 	}
 	ret := s.rNum
 	if increment {
 		s.rNum++
 	}
-	log.Tracef("r_key=%d", s.keyMap[ret])
+	if s.Logger != nil {
+		s.Logger.Tracef("r_key=%d", s.keyMap[ret])
+	}
 	return s.keyMap[ret]
 }
 
@@ -110,26 +155,37 @@ func (s *SecurityKey) RKey(increment bool) byte {
 // The returned value is XORed with the raw packet before sending
 // it to the car.
 func (s *SecurityKey) SKey(increment bool) byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if len(s.keyMap) == 0 {
-		log.Tracef("s_key=empty")
+		if s.Logger != nil {
+			s.Logger.Tracef("s_key=empty")
+		}
 		return 0
 	}
 	ret := s.sNum
 	if increment {
 		s.sNum++
 	}
-	log.Tracef("s_key=%d", s.keyMap[ret])
+	if s.Logger != nil {
+		s.Logger.Tracef("s_key=%d", s.keyMap[ret])
+	}
 	return s.keyMap[ret]
 }
 
 func XorMessageWith(message []byte, xor byte) []byte {
 	msg := make([]byte, len(message))
-	for i := range message {
-		msg[i] = message[i] ^ xor
-	}
+	xorInto(msg, message, xor)
 	return msg
 }
 
+// xorInto XORs src into dst, which may be the same slice.
+func xorInto(dst, src []byte, xor byte) {
+	for i := range src {
+		dst[i] = src[i] ^ xor
+	}
+}
+
 func Checksum(message []byte) byte {
 	length := message[1] + 2
 
@@ -154,25 +210,64 @@ func ValidateChecksum(message []byte) bool {
 }
 
 // Validate and decode message. Returns the decoded/validated message,
-// plus any trailing data.
+// plus any trailing data. Returns nils if message is not valid, see
+// DecodeFrame for the reason.
 func ValidateAndDecodeMessage(message []byte) ([]byte, byte, []byte) {
-	if len(message) < 4 {
-		log.Debugf("Short msg\n")
+	msg, xor, rem, err := DecodeFrame(message)
+	if err != nil {
 		return nil, 0, nil
 	}
-	xor := message[2]
-	msg := XorMessageWith(message, xor)
-	if !ValidateChecksum(msg) {
-		xor ^= 1
-		msg = XorMessageWith(message, xor)
-		if !ValidateChecksum(msg) {
-			log.Debugf("Bad sum for (%s)\n", hex.EncodeToString(message))
-			return nil, 0, nil
+	return msg, xor, rem
+}
+
+// validFrame checks for a complete frame with a valid checksum at the
+// start of message once XORed with xor, returning its length. It is
+// the same as ValidateChecksum(XorMessageWith(message, xor)), without
+// the copy.
+func validFrame(message []byte, xor byte) (int, bool) {
+	length := int(message[1]^xor) + 2
+	if length > maxFrameLength || len(message) < length {
+		return 0, false
+	}
+	var sum byte
+	for _, b := range message[:length-1] {
+		sum += b ^ xor
+	}
+	return length, sum == message[length-1]^xor
+}
+
+// findFrame returns the length and XOR value of the frame at the start
+// of message. The error is a *ShortFrameError or *ChecksumError if no
+// frame is found.
+func findFrame(message []byte) (int, byte, error) {
+	if len(message) < 4 {
+		return 0, 0, &ShortFrameError{Data: message}
+	}
+	for _, xor := range []byte{message[2], message[2] ^ 1} {
+		if length, ok := validFrame(message, xor); ok {
+			return length, xor, nil
+		}
+	}
+	// The frame may be incomplete under either XOR value.
+	for _, xor := range []byte{message[2], message[2] ^ 1} {
+		if length := int(message[1]^xor) + 2; length <= maxFrameLength && length > len(message) {
+			return 0, 0, &ShortFrameError{Data: message}
 		}
 	}
-	length := msg[1] + 2
-	if len(message) > int(length) {
-		return msg[:length], xor, message[length:]
+	return 0, 0, &ChecksumError{Data: message}
+}
+
+// DecodeFrame validates and un-XORs the frame at the start of message,
+// returning it along with the XOR value and any trailing data. The
+// error is a *ShortFrameError or *ChecksumError if no frame is found.
+func DecodeFrame(message []byte) ([]byte, byte, []byte, error) {
+	length, xor, err := findFrame(message)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	msg := XorMessageWith(message[:length], xor)
+	if len(message) > length {
+		return msg, xor, message[length:], nil
 	}
-	return msg[:length], xor, nil
+	return msg, xor, nil, nil
 }
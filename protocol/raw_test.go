@@ -54,7 +54,7 @@ func TestXorMessage(t *testing.T) {
 			}
 			got := XorMessageWith(in, test.xor)
 			if diff := hexCmp(got, test.want); diff != "" {
-				t.Errorf(diff)
+				t.Error(diff)
 			}
 		})
 	}
@@ -161,3 +161,17 @@ func TestValidateAndDecodeMessage(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkDecodeFrame(b *testing.B) {
+	// The second XOR value is the valid one.
+	in, err := hex.DecodeString("4ab8bd95bc98")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := DecodeFrame(in); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"fmt"
+)
+
+// The number of frames each direction used to recover the key. More
+// frames make a false match less likely, but take longer.
+const maxRecoverFrames = 64
+
+// The fewest frames that must match the recovered key stream.
+const minRecoverFrames = 4
+
+// A recoverFrame is a frame seen during key recovery, with the XOR
+// values which give it a valid checksum.
+type recoverFrame struct {
+	xors      []byte
+	increment bool
+}
+
+// Message types sent by the car, which use the receive key index.
+var inTypes = map[byte]bool{
+	CmdInPingResp:    true,
+	CmdInResp:        true,
+	CmdInBadEncoding: true,
+	CmdInUnkn3:       true,
+	CmdInStartResp:   true,
+	CmdInUnkn4:       true,
+}
+
+// Message types sent to the car, which use the send key index.
+var outTypes = map[byte]bool{
+	CmdOutPingReq:       true,
+	CmdOutSend:          true,
+	CmdOutStartSendMy18: true,
+}
+
+// RecoverKey finds the session key for a capture which starts after
+// the security init (0x5e/0x4e/0x6e) message. Each of the 256 possible
+// security keys is tried at every receive and send key map index, and
+// the one giving valid checksums for the most frames is returned,
+// positioned to decode data from its start.
+func RecoverKey(data []byte) (*SecurityKey, error) {
+	in, out, err := recoverFrames(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(in)+len(out) < minRecoverFrames {
+		return nil, fmt.Errorf("too few frames to recover key: %d", len(in)+len(out))
+	}
+
+	var best *SecurityKey
+	bestScore, ties := -1, 0
+	for k := 0; k < 256; k++ {
+		key := &SecurityKey{}
+		key.setKey(byte(k))
+		rNum, rScore := key.bestIndex(in)
+		sNum, sScore := key.bestIndex(out)
+		switch score := rScore + sScore; {
+		case score > bestScore:
+			bestScore, ties = score, 0
+			key.rNum, key.sNum = rNum, sNum
+			best = key
+		case score == bestScore:
+			ties++
+		}
+	}
+	switch {
+	case bestScore < minRecoverFrames:
+		return nil, fmt.Errorf("no key found, best matched %d of %d frames", bestScore, len(in)+len(out))
+	case ties > 0:
+		return nil, fmt.Errorf("key is ambiguous, %d keys match %d of %d frames", ties+1, bestScore, len(in)+len(out))
+	}
+	best.State = SecurityKeyAccepted
+	return best, nil
+}
+
+// recoverFrames splits data into frames, up to the first security
+// init, returning those sent by and to the car.
+func recoverFrames(data []byte) ([]recoverFrame, []recoverFrame, error) {
+	var in, out []recoverFrame
+	for len(data) > 0 && (len(in) < maxRecoverFrames || len(out) < maxRecoverFrames) {
+		msg, _, rem, err := DecodeFrame(data)
+		if err != nil {
+			// Skip a byte to resync, as the Decoder does.
+			data = data[1:]
+			continue
+		}
+		frame := data[:len(msg)]
+		data = rem
+		switch {
+		case msg[0] == CmdInMy14StartReq || msg[0] == CmdInMy18StartReq || msg[0] == CmdInMy24StartReq:
+			if len(in)+len(out) == 0 {
+				return nil, nil, fmt.Errorf("capture starts with a security init, no need to recover key")
+			}
+			return in, out, nil
+		case inTypes[msg[0]] && len(in) < maxRecoverFrames:
+			in = append(in, recoverFrame{xors: validXors(frame), increment: msg[0] == CmdInResp})
+		case outTypes[msg[0]] && len(out) < maxRecoverFrames:
+			out = append(out, recoverFrame{xors: validXors(frame), increment: msg[0] == CmdOutSend})
+		}
+	}
+	return in, out, nil
+}
+
+// validXors returns the XOR values giving frame a valid checksum.
+func validXors(frame []byte) []byte {
+	xors := []byte{}
+	for _, x := range []byte{frame[2], frame[2] ^ 1} {
+		if _, ok := validFrame(frame, x); ok {
+			xors = append(xors, x)
+		}
+	}
+	return xors
+}
+
+// bestIndex returns the key map index from which the most frames
+// have a valid checksum, along with that count.
+func (s *SecurityKey) bestIndex(frames []recoverFrame) (byte, int) {
+	var best byte
+	bestScore := 0
+	for start := 0; start < 256; start++ {
+		idx, score := byte(start), 0
+		for _, f := range frames {
+			for _, x := range f.xors {
+				if x == s.keyMap[idx] {
+					score++
+					break
+				}
+			}
+			if f.increment {
+				idx++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = byte(start), score
+		}
+	}
+	return best, bestScore
+}
+
+func (s *SecurityKey) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("key=0x%02x rNum=%d sNum=%d", s.securityKey, s.rNum, s.sNum)
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"testing"
+)
+
+// captureFrom returns a mid-session capture, with the car and client
+// keys starting at the given key map indices.
+func captureFrom(securityKey, rNum, sNum byte) ([]byte, *SecurityKey) {
+	key := &SecurityKey{}
+	key.setKey(securityKey)
+	key.rNum, key.sNum = rNum, sNum
+
+	plain := &SecurityKey{}
+	fromCar := func(m *PhevMessage, increment bool) []byte {
+		return XorMessageWith(m.EncodeToBytes(plain), key.RKey(increment))
+	}
+	capture := []byte{}
+	for i := byte(0); i < 8; i++ {
+		capture = append(capture, NewPingRequestMessage(i).EncodeToBytes(key)...)
+		capture = append(capture, fromCar(NewPingResponseMessage(i), false)...)
+		capture = append(capture, fromCar(NewMessage(CmdInResp, ChargePlugRegister, false, []byte{0x1, i}), true)...)
+		capture = append(capture, NewMessage(CmdOutSend, ChargePlugRegister, true, []byte{0x0}).EncodeToBytes(key)...)
+	}
+	return capture, key
+}
+
+func TestRecoverKey(t *testing.T) {
+	tests := []struct {
+		securityKey, rNum, sNum byte
+	}{
+		{0x9f, 0, 0},
+		{0x9f, 37, 12},
+		{0x01, 250, 3},
+	}
+	for _, test := range tests {
+		capture, sessionKey := captureFrom(test.securityKey, test.rNum, test.sNum)
+		key, err := RecoverKey(capture)
+		if err != nil {
+			t.Fatalf("RecoverKey(): %v", err)
+		}
+		if got, want := key.String(), (&SecurityKey{securityKey: test.securityKey, rNum: test.rNum, sNum: test.sNum}).String(); got != want {
+			t.Errorf("RecoverKey() got=%s want=%s", got, want)
+		}
+		// Decoding the capture should follow the session key stream.
+		if _, errs := DecodeBytes(capture, key); len(errs) > 0 {
+			t.Errorf("DecodeBytes() errors: %v", errs)
+		}
+		if got, want := key.String(), sessionKey.String(); got != want {
+			t.Errorf("key after decode got=%s want=%s", got, want)
+		}
+	}
+}
+
+func TestRecoverKeyErrors(t *testing.T) {
+	capture, _ := captureFrom(0x9f, 37, 12)
+	start := NewMessage(CmdInMy18StartReq, 0x1, false, make([]byte, 8)).EncodeToBytes(&SecurityKey{})
+
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"too few frames", capture[:12]},
+		{"starts with init", append(append([]byte{}, start...), capture...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if key, err := RecoverKey(test.in); err == nil {
+				t.Errorf("RecoverKey() got=%s want error", key)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ModelYear identifies the car generation, which determines the layout
+// of some registers.
+type ModelYear int64
+
+const (
+	ModelYearUnknown ModelYear = iota
+	ModelYear14
+	ModelYear18
+	ModelYear24
+)
+
+func (y ModelYear) String() string {
+	switch y {
+	case ModelYear14:
+		return "MY14"
+	case ModelYear18:
+		return "MY18"
+	case ModelYear24:
+		return "MY24"
+	default:
+		return "unknown"
+	}
+}
+
+// modelYearFromStart returns the model year announced by a start request
+// message type.
+func modelYearFromStart(t byte) ModelYear {
+	switch t {
+	case CmdInMy14StartReq:
+		return ModelYear14
+	case CmdInMy18StartReq:
+		return ModelYear18
+	case CmdInMy24StartReq:
+		return ModelYear24
+	}
+	return ModelYearUnknown
+}
+
+// RegisterFactory returns a new, empty Register ready to Decode into.
+type RegisterFactory func() Register
+
+type registryKey struct {
+	register byte
+	year     ModelYear
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[registryKey]RegisterFactory{}
+)
+
+// RegisterDecoder installs the decoder for a register for all model
+// years. It replaces any existing decoder for that register, including
+// the built in ones.
+func RegisterDecoder(register byte, f RegisterFactory) {
+	RegisterModelDecoder(register, ModelYearUnknown, f)
+}
+
+// RegisterModelDecoder installs the decoder for a register on a single
+// model year. It takes precedence over a decoder installed for all
+// model years. Passing ModelYearUnknown is the same as RegisterDecoder.
+func RegisterModelDecoder(register byte, year ModelYear, f RegisterFactory) {
+	if f == nil {
+		panic(fmt.Sprintf("protocol: nil decoder for register 0x%02x", register))
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[registryKey{register, year}] = f
+}
+
+// UnregisterDecoder removes the decoder for a register and model year,
+// so that the register decodes as RegisterGeneric (or the all model
+// year decoder, if there is one).
+func UnregisterDecoder(register byte, year ModelYear) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, registryKey{register, year})
+}
+
+// NewRegister returns an empty Register for decoding the given register
+// on the given model year. A model year specific decoder is preferred,
+// then one for all model years, falling back to RegisterGeneric.
+func NewRegister(register byte, year ModelYear) Register {
+	registryMu.RLock()
+	f, ok := registry[registryKey{register, year}]
+	if !ok {
+		f, ok = registry[registryKey{register, ModelYearUnknown}]
+	}
+	registryMu.RUnlock()
+	if !ok {
+		return new(RegisterGeneric)
+	}
+	return f()
+}
+
+func init() {
+	for reg, f := range map[byte]RegisterFactory{
+		VINRegister:             func() Register { return new(RegisterVIN) },
+		SettingsRegister:        func() Register { return new(RegisterSettings) },
+		TimeRegister:            func() Register { return new(RegisterTime) },
+		ECUVersionRegister:      func() Register { return new(RegisterECUVersion) },
+		BatteryLevelRegister:    func() Register { return new(RegisterBatteryLevel) },
+		BatteryWarningRegister:  func() Register { return new(RegisterBatteryWarning) },
+		DoorStatusRegister:      func() Register { return new(RegisterDoorStatus) },
+		ChargePlugRegister:      func() Register { return new(RegisterChargePlug) },
+		ChargeStatusRegister:    func() Register { return new(RegisterChargeStatus) },
+		PreACStateRegister:      func() Register { return new(RegisterPreACState) },
+		ACOperStatusRegister:    func() Register { return new(RegisterACOperStatus) },
+		ACModeRegister:          func() Register { return new(RegisterACMode) },
+		WIFISSIDRegister:        func() Register { return new(RegisterWIFISSID) },
+		LightStatusRegister:     func() Register { return new(RegisterLightStatus) },
+		ClimateScheduleRegister: func() Register { return new(RegisterClimateSchedule) },
+		ChargeScheduleRegister:  func() Register { return new(RegisterChargeSchedule) },
+	} {
+		RegisterDecoder(reg, f)
+	}
+}
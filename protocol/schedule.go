@@ -0,0 +1,365 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Weekdays is a set of days on which a timer repeats. Bit n is set if
+// the timer runs on time.Weekday(n).
+type Weekdays uint8
+
+// Has returns true if the timer runs on day d.
+func (w Weekdays) Has(d time.Weekday) bool {
+	return w&(1<<uint(d)) != 0
+}
+
+// Set adds day d to the set.
+func (w *Weekdays) Set(d time.Weekday) {
+	*w |= 1 << uint(d)
+}
+
+func (w Weekdays) String() string {
+	days := []string{}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if w.Has(d) {
+			days = append(days, d.String()[:3])
+		}
+	}
+	if len(days) == 0 {
+		return "once"
+	}
+	return strings.Join(days, ",")
+}
+
+// The number of timers in the climate schedule.
+const climateTimerCount = 5
+
+// An unused timer slot is sent by the car, and cleared by the app,
+// with this value.
+const climateTimerUnused = 0x07fe00
+
+// ClimateTimer is a single pre-conditioning timer.
+type ClimateTimer struct {
+	// InUse is false if the timer slot is empty.
+	InUse bool `json:"in_use"`
+	// Enabled is true if the timer is switched on.
+	Enabled bool `json:"enabled"`
+	// Hour and Minute are the start time. Minute is in 10 minute steps.
+	Hour   int `json:"hour"`
+	Minute int `json:"minute"`
+	// Duration is the run time in minutes (10, 20 or 30).
+	Duration uint8 `json:"duration"`
+	// Days are the days the timer repeats on.
+	Days Weekdays `json:"days"`
+}
+
+// decodeClimateTimer decodes a timer from its 3 byte little endian
+// form:
+//
+//	bits 0-1:   duration (0=10min 1=20min 2=30min)
+//	bits 2-8:   weekdays, sunday first
+//	bits 9-11:  minute in 10 minute steps
+//	bits 12-16: hour
+//	bit 17:     enabled
+//	bit 18:     disabled
+func decodeClimateTimer(b []byte) ClimateTimer {
+	v := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+	if v&0x60000 == 0x60000 {
+		// Both enabled and disabled bits are set on an unused slot.
+		return ClimateTimer{}
+	}
+	return ClimateTimer{
+		InUse:    true,
+		Enabled:  v&(1<<17) != 0,
+		Hour:     int(v>>12) & 0x1f,
+		Minute:   int((v>>9)&0x7) * 10,
+		Duration: uint8(v&0x3+1) * 10,
+		Days:     Weekdays(v>>2) & 0x7f,
+	}
+}
+
+func (t ClimateTimer) encode() []byte {
+	v := uint32(climateTimerUnused)
+	if t.InUse {
+		v = uint32(t.Days&0x7f) << 2
+		if t.Duration >= 10 {
+			v |= uint32(t.Duration/10-1) & 0x3
+		}
+		v |= uint32(t.Minute/10) & 0x7 << 9
+		v |= uint32(t.Hour) & 0x1f << 12
+		if t.Enabled {
+			v |= 1 << 17
+		} else {
+			v |= 1 << 18
+		}
+	}
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+}
+
+// Validate checks the timer fields are within range for encoding.
+func (t ClimateTimer) Validate() error {
+	if !t.InUse {
+		return nil
+	}
+	switch {
+	case t.Hour < 0 || t.Hour > 23:
+		return fmt.Errorf("hour out of range: %d", t.Hour)
+	case t.Minute < 0 || t.Minute > 50 || t.Minute%10 != 0:
+		return fmt.Errorf("minute must be a multiple of 10 up to 50: %d", t.Minute)
+	case t.Duration != 10 && t.Duration != 20 && t.Duration != 30:
+		return fmt.Errorf("duration must be 10, 20 or 30 minutes: %d", t.Duration)
+	case t.Days > 0x7f:
+		return fmt.Errorf("invalid weekdays: 0x%02x", uint8(t.Days))
+	}
+	return nil
+}
+
+func (t ClimateTimer) String() string {
+	if !t.InUse {
+		return "unused"
+	}
+	state := "disabled"
+	if t.Enabled {
+		state = "enabled"
+	}
+	return fmt.Sprintf("%02d:%02d %dmin %s %s", t.Hour, t.Minute, t.Duration, t.Days, state)
+}
+
+// RegisterClimateSchedule holds the climate timer schedule, read from
+// register 0x05 and written to register 0x1a.
+type RegisterClimateSchedule struct {
+	Timers [climateTimerCount]ClimateTimer `json:"timers"`
+	// Leading byte of the 0x05 register, meaning unknown.
+	header byte
+	raw    []byte
+}
+
+func (r *RegisterClimateSchedule) Decode(m *PhevMessage) {
+	// MY'18 data length is 16 bytes, MY'14 uses 1 byte which is not
+	// understood.
+	if m.Register != ClimateScheduleRegister || len(m.Data) != 16 {
+		return
+	}
+	r.header = m.Data[0]
+	for i := range r.Timers {
+		r.Timers[i] = decodeClimateTimer(m.Data[1+i*3 : 4+i*3])
+	}
+	r.raw = m.Data
+}
+
+// Encode returns the schedule as it is sent by the car in register 0x05.
+func (r *RegisterClimateSchedule) Encode() *PhevMessage {
+	data := []byte{r.header}
+	for _, t := range r.Timers {
+		data = append(data, t.encode()...)
+	}
+	return &PhevMessage{
+		Register: r.Register(),
+		Data:     data,
+	}
+}
+
+// EncodeSet returns a message to write the schedule to the car via
+// register 0x1a.
+func (r *RegisterClimateSchedule) EncodeSet() (*PhevMessage, error) {
+	data := []byte{}
+	for i, t := range r.Timers {
+		if err := t.Validate(); err != nil {
+			return nil, fmt.Errorf("timer %d: %v", i+1, err)
+		}
+		data = append(data, t.encode()...)
+	}
+	// Trailing byte is always 0x1 from the app, meaning unknown.
+	data = append(data, 0x1)
+	return NewMessage(CmdOutSend, SetClimateScheduleRegister, false, data), nil
+}
+
+func (r *RegisterClimateSchedule) Raw() string {
+	return hex.EncodeToString(r.raw)
+}
+
+func (r *RegisterClimateSchedule) String() string {
+	timers := []string{}
+	for i, t := range r.Timers {
+		timers = append(timers, fmt.Sprintf("%d: %s", i+1, t))
+	}
+	return fmt.Sprintf("Climate timers: %s", strings.Join(timers, "; "))
+}
+
+func (r *RegisterClimateSchedule) Register() byte {
+	return ClimateScheduleRegister
+}
+
+// The number of timers in the charge schedule.
+const chargeTimerCount = 5
+
+// Per-timer state byte in the charge schedule.
+const (
+	chargeTimerEnabled  = 0x1
+	chargeTimerDisabled = 0x2
+	chargeTimerUnused   = 0x3
+)
+
+// ChargeTimer is a single charging window.
+type ChargeTimer struct {
+	// InUse is false if the timer slot is empty.
+	InUse bool `json:"in_use"`
+	// Enabled is true if the timer is switched on.
+	Enabled bool `json:"enabled"`
+	// Days are the days the window applies to.
+	Days Weekdays `json:"days"`
+	// Start and end of the window. Minutes are in 10 minute steps.
+	StartHour   int `json:"start_hour"`
+	StartMinute int `json:"start_minute"`
+	EndHour     int `json:"end_hour"`
+	EndMinute   int `json:"end_minute"`
+	// Top bit of the weekday byte, meaning unknown.
+	flag bool
+}
+
+// Charge timer times are a single byte, hour in the top 5 bits and
+// 10 minute slot in the bottom 3.
+func decodeChargeTime(b byte) (int, int) {
+	return int(b >> 3), int(b&0x7) * 10
+}
+
+func encodeChargeTime(hour, minute int) byte {
+	return byte(hour)<<3 | byte(minute/10)&0x7
+}
+
+// decodeChargeTimer decodes a 4 byte timer slot:
+//
+//	byte 0: weekdays, sunday in bit 0. Bit 7 unknown.
+//	byte 1: end time
+//	byte 2: start time
+//	byte 3: state (1=enabled 2=disabled 3=unused)
+func decodeChargeTimer(b []byte) ChargeTimer {
+	if b[3] == chargeTimerUnused {
+		return ChargeTimer{}
+	}
+	t := ChargeTimer{
+		InUse:   true,
+		Enabled: b[3] == chargeTimerEnabled,
+		Days:    Weekdays(b[0] & 0x7f),
+		flag:    b[0]&0x80 != 0,
+	}
+	t.EndHour, t.EndMinute = decodeChargeTime(b[1])
+	t.StartHour, t.StartMinute = decodeChargeTime(b[2])
+	return t
+}
+
+func (t ChargeTimer) encode() []byte {
+	if !t.InUse {
+		return []byte{0x00, 0xff, 0xff, chargeTimerUnused}
+	}
+	days := byte(t.Days & 0x7f)
+	if t.flag {
+		days |= 0x80
+	}
+	state := byte(chargeTimerDisabled)
+	if t.Enabled {
+		state = chargeTimerEnabled
+	}
+	return []byte{
+		days,
+		encodeChargeTime(t.EndHour, t.EndMinute),
+		encodeChargeTime(t.StartHour, t.StartMinute),
+		state,
+	}
+}
+
+// Validate checks the timer fields are within range for encoding.
+func (t ChargeTimer) Validate() error {
+	if !t.InUse {
+		return nil
+	}
+	switch {
+	case t.StartHour < 0 || t.StartHour > 23:
+		return fmt.Errorf("start hour out of range: %d", t.StartHour)
+	case t.EndHour < 0 || t.EndHour > 23:
+		return fmt.Errorf("end hour out of range: %d", t.EndHour)
+	case t.StartMinute < 0 || t.StartMinute > 50 || t.StartMinute%10 != 0:
+		return fmt.Errorf("start minute must be a multiple of 10 up to 50: %d", t.StartMinute)
+	case t.EndMinute < 0 || t.EndMinute > 50 || t.EndMinute%10 != 0:
+		return fmt.Errorf("end minute must be a multiple of 10 up to 50: %d", t.EndMinute)
+	case t.Days > 0x7f:
+		return fmt.Errorf("invalid weekdays: 0x%02x", uint8(t.Days))
+	}
+	return nil
+}
+
+func (t ChargeTimer) String() string {
+	if !t.InUse {
+		return "unused"
+	}
+	state := "disabled"
+	if t.Enabled {
+		state = "enabled"
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d %s %s", t.StartHour, t.StartMinute, t.EndHour, t.EndMinute, t.Days, state)
+}
+
+// RegisterChargeSchedule holds the charge timer schedule, read from
+// register 0x04 and written to register 0x19.
+type RegisterChargeSchedule struct {
+	Timers [chargeTimerCount]ChargeTimer `json:"timers"`
+	raw    []byte
+}
+
+func (r *RegisterChargeSchedule) Decode(m *PhevMessage) {
+	// MY'18 data length is 20 bytes, MY'14 uses 1 byte which is not
+	// understood.
+	if m.Register != ChargeScheduleRegister || len(m.Data) != 20 {
+		return
+	}
+	for i := range r.Timers {
+		r.Timers[i] = decodeChargeTimer(m.Data[i*4 : i*4+4])
+	}
+	r.raw = m.Data
+}
+
+// Encode returns the schedule as it is sent by the car in register 0x04.
+func (r *RegisterChargeSchedule) Encode() *PhevMessage {
+	data := []byte{}
+	for _, t := range r.Timers {
+		data = append(data, t.encode()...)
+	}
+	return &PhevMessage{
+		Register: r.Register(),
+		Data:     data,
+	}
+}
+
+// EncodeSet returns a message to write the schedule to the car via
+// register 0x19.
+func (r *RegisterChargeSchedule) EncodeSet() (*PhevMessage, error) {
+	data := []byte{}
+	for i, t := range r.Timers {
+		if err := t.Validate(); err != nil {
+			return nil, fmt.Errorf("timer %d: %v", i+1, err)
+		}
+		data = append(data, t.encode()...)
+	}
+	// Trailing byte is always 0x2 from the app, meaning unknown.
+	data = append(data, 0x2)
+	return NewMessage(CmdOutSend, SetChargeScheduleRegister, false, data), nil
+}
+
+func (r *RegisterChargeSchedule) Raw() string {
+	return hex.EncodeToString(r.raw)
+}
+
+func (r *RegisterChargeSchedule) String() string {
+	timers := []string{}
+	for i, t := range r.Timers {
+		timers = append(timers, fmt.Sprintf("%d: %s", i+1, t))
+	}
+	return fmt.Sprintf("Charge timers: %s", strings.Join(timers, "; "))
+}
+
+func (r *RegisterChargeSchedule) Register() byte {
+	return ChargeScheduleRegister
+}
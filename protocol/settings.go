@@ -3,19 +3,106 @@ package protocol
 import (
 	"encoding/binary"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	//        log "github.com/sirupsen/logrus"
 )
 
-// Vehicle settings are sent to the client in register 0x16.
-// The client sends updated settings to the vehicle via register 0x0f.
-type Settings struct {
-	settings []uint64
+// SettingID identifies a single vehicle setting.
+type SettingID byte
+
+// Known setting IDs, as sent to register 0x0f by the app.
+const (
+	SettingChargeLightCutout    SettingID = 0x07
+	SettingHeadlightsOnExit     SettingID = 0x2a
+	SettingLightsOnRemoteUnlock SettingID = 0x2b
+)
+
+var settingNames = map[SettingID]string{
+	SettingChargeLightCutout:    "Charge light cutout",
+	SettingHeadlightsOnExit:     "Headlights on exit",
+	SettingLightsOnRemoteUnlock: "Lights on remote unlock",
 }
 
-// FromRegister extracts settings from the 0x16 register. They appear
-// to be little endian and need decoding, though this is not yet certain.
-func (s *Settings) FromRegister(reg []byte) error {
+// Names of each value of the known settings, indexed by value.
+var settingValues = map[SettingID][]string{
+	SettingChargeLightCutout:    {"off", "1min", "2min", "5min", "10min"},
+	SettingHeadlightsOnExit:     {"off", "15s", "30s", "1min", "3min"},
+	SettingLightsOnRemoteUnlock: {"off", "parking", "head"},
+}
+
+func (id SettingID) String() string {
+	if name, ok := settingNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("Setting 0x%02x", byte(id))
+}
+
+// Setting is a single decoded vehicle setting. Each 0x16 register holds
+// three settings, each as a 16 bit little endian value:
+//
+//	bits 0-5:  setting ID
+//	bits 6-8:  current value
+//	bits 9-15: supported values, bit n+9 set if value n is allowed
+//
+// The layout is inferred from the app changing settings and may not be
+// complete.
+type Setting struct {
+	ID    SettingID
+	Value int
+	// Options is the mask of supported values, bit n set if value n
+	// is allowed. Zero if the car does not report them.
+	Options uint8
+}
+
+func decodeSetting(b []byte) Setting {
+	v := binary.LittleEndian.Uint16(b)
+	return Setting{
+		ID:      SettingID(v & 0x3f),
+		Value:   int(v>>6) & 0x7,
+		Options: uint8(v >> 9),
+	}
+}
+
+func (s Setting) encode() []byte {
+	v := uint16(s.ID&0x3f) | uint16(s.Value&0x7)<<6 | uint16(s.Options&0x7f)<<9
+	return []byte{byte(v), byte(v >> 8)}
+}
+
+// Supports returns true if value is valid for the setting.
+func (s Setting) Supports(value int) bool {
+	if value < 0 || value > 7 {
+		return false
+	}
+	if names, ok := settingValues[s.ID]; ok && value >= len(names) {
+		return false
+	}
+	return s.Options == 0 || s.Options&(1<<uint(value)) != 0
+}
+
+// ValueString returns the current value, named if known.
+func (s Setting) ValueString() string {
+	if names, ok := settingValues[s.ID]; ok && s.Value < len(names) {
+		return names[s.Value]
+	}
+	return fmt.Sprintf("%d", s.Value)
+}
+
+func (s Setting) String() string {
+	return fmt.Sprintf("%s: %s", s.ID, s.ValueString())
+}
+
+// decodeSettings returns the three settings held in a 0x16 register.
+func decodeSettings(reg []byte) []Setting {
+	settings := []Setting{}
+	for i := 1; i+2 <= 7; i += 2 {
+		settings = append(settings, decodeSetting(reg[i:i+2]))
+	}
+	return settings
+}
+
+func validateSettingsRegister(reg []byte) error {
 	switch {
 	case len(reg) != 8:
 		return fmt.Errorf("register wrong length got=%d want=8", len(reg))
@@ -24,6 +111,31 @@ func (s *Settings) FromRegister(reg []byte) error {
 	case reg[7] != 0x0:
 		return fmt.Errorf("register must end with 0x0, is 0x%x", reg[7])
 	}
+	return nil
+}
+
+// Vehicle settings are sent to the client in register 0x16.
+// The client sends updated settings to the vehicle via register 0x0f,
+// followed by 0x0e to save them.
+type Settings struct {
+	mu       sync.Mutex
+	settings []uint64
+	values   map[SettingID]Setting
+}
+
+// FromRegister extracts settings from the 0x16 register.
+func (s *Settings) FromRegister(reg []byte) error {
+	if err := validateSettingsRegister(reg); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = map[SettingID]Setting{}
+	}
+	for _, v := range decodeSettings(reg) {
+		s.values[v.ID] = v
+	}
 	value := binary.LittleEndian.Uint64(reg)
 	for _, v := range s.settings {
 		if value == v {
@@ -34,15 +146,68 @@ func (s *Settings) FromRegister(reg []byte) error {
 	return nil
 }
 
+// Get returns the setting with the given ID, if it has been received.
+func (s *Settings) Get(id SettingID) (Setting, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[id]
+	return v, ok
+}
+
+// All returns all received settings, ordered by ID.
+func (s *Settings) All() []Setting {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []Setting{}
+	for _, v := range s.values {
+		ret = append(ret, v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// Set changes a setting value, returning the updated 0x16 register
+// holding it.
+func (s *Settings) Set(id SettingID, value int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range s.settings {
+		reg := make([]byte, 8)
+		binary.LittleEndian.PutUint64(reg, v)
+		for j := 1; j+2 <= 7; j += 2 {
+			setting := decodeSetting(reg[j : j+2])
+			if setting.ID != id {
+				continue
+			}
+			if !setting.Supports(value) {
+				return nil, fmt.Errorf("unsupported value %d for %s", value, id)
+			}
+			setting.Value = value
+			copy(reg[j:j+2], setting.encode())
+			s.settings[i] = binary.LittleEndian.Uint64(reg)
+			s.values[id] = setting
+			return reg, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown setting %s", id)
+}
+
 func (s *Settings) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.settings = []uint64{}
+	s.values = map[SettingID]Setting{}
 }
 
 func (s *Settings) NewSender() *SettingsSender {
-	return &SettingsSender{settings: s.settings}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &SettingsSender{settings: append([]uint64{}, s.settings...)}
 }
 
 func (s *Settings) Dump() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	ret := []string{}
 	for _, v := range s.settings {
 		ret = append(ret, fmt.Sprintf("%016x", v))
@@ -50,6 +215,21 @@ func (s *Settings) Dump() string {
 	return strings.Join(ret, "\n")
 }
 
+// NewSettingMessages returns the messages to change a single setting:
+// the new value to register 0x0f, then a save to register 0x0e.
+func NewSettingMessages(id SettingID, value int) ([]*PhevMessage, error) {
+	if id > 0x3f {
+		return nil, fmt.Errorf("invalid setting id 0x%02x", byte(id))
+	}
+	if !(Setting{ID: id}).Supports(value) {
+		return nil, fmt.Errorf("unsupported value %d for %s", value, id)
+	}
+	return []*PhevMessage{
+		NewMessage(CmdOutSend, UpdateSettingsRegister, false, []byte{byte(id), byte(value)}),
+		NewMessage(CmdOutSend, SaveSettingsRegister, false, []byte{0x0}),
+	}, nil
+}
+
 type SettingsSender struct {
 	C        chan *PhevMessage
 	settings []uint64
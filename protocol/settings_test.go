@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"gopkg.in/d4l3k/messagediff.v1"
+)
+
+func TestSettingsFromRegister(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []Setting
+	}{
+		{
+			in: "026b0e2c002d0000",
+			want: []Setting{
+				{ID: SettingLightsOnRemoteUnlock, Value: 1, Options: 0x07},
+				{ID: 0x2c},
+				{ID: 0x2d},
+			},
+		}, {
+			in: "02473ec81e093f00",
+			want: []Setting{
+				{ID: SettingChargeLightCutout, Value: 1, Options: 0x1f},
+				{ID: 0x08, Value: 3, Options: 0x0f},
+				{ID: 0x09, Value: 4, Options: 0x1f},
+			},
+		}, {
+			in: "02e801e9016a3e00",
+			want: []Setting{
+				{ID: 0x28, Value: 7},
+				{ID: 0x29, Value: 7},
+				{ID: SettingHeadlightsOnExit, Value: 1, Options: 0x1f},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			data, err := hex.DecodeString(test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &Settings{}
+			if err := s.FromRegister(data); err != nil {
+				t.Fatal(err)
+			}
+			if diff, eq := messagediff.PrettyDiff(test.want, s.All()); !eq {
+				t.Errorf("All() diff=%s", diff)
+			}
+			r := &RegisterSettings{}
+			r.Decode(&PhevMessage{Register: SettingsRegister, Data: data})
+			if diff, eq := messagediff.PrettyDiff(test.want, r.Settings); !eq {
+				t.Errorf("RegisterSettings diff=%s", diff)
+			}
+		})
+	}
+}
+
+func TestSettingsSet(t *testing.T) {
+	s := &Settings{}
+	data, _ := hex.DecodeString("02e801e9016a3e00")
+	if err := s.FromRegister(data); err != nil {
+		t.Fatal(err)
+	}
+	reg, err := s.Set(SettingHeadlightsOnExit, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(reg), "02e801e901ea3e00"; got != want {
+		t.Errorf("Set() got=%s want=%s", got, want)
+	}
+	if v, _ := s.Get(SettingHeadlightsOnExit); v.ValueString() != "1min" {
+		t.Errorf("Get() got=%s want=1min", v.ValueString())
+	}
+	if _, err := s.Set(SettingHeadlightsOnExit, 5); err == nil {
+		t.Errorf("Set() out of range value, want error")
+	}
+	if _, err := s.Set(SettingChargeLightCutout, 1); err == nil {
+		t.Errorf("Set() unknown setting, want error")
+	}
+}
+
+func TestNewSettingMessages(t *testing.T) {
+	msgs, err := NewSettingMessages(SettingLightsOnRemoteUnlock, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	if msgs[0].Register != UpdateSettingsRegister || hex.EncodeToString(msgs[0].Data) != "2b02" {
+		t.Errorf("update got reg 0x%02x data %x, want 0x0f 2b02", msgs[0].Register, msgs[0].Data)
+	}
+	if msgs[1].Register != SaveSettingsRegister || hex.EncodeToString(msgs[1].Data) != "00" {
+		t.Errorf("save got reg 0x%02x data %x, want 0x0e 00", msgs[1].Register, msgs[1].Data)
+	}
+	if _, err := NewSettingMessages(SettingLightsOnRemoteUnlock, 3); err == nil {
+		t.Errorf("out of range value, want error")
+	}
+}
@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// VehicleState is a snapshot of the vehicle, built by folding in
+// registers as they are decoded. Fields are nil until the corresponding
+// register has been received. It is not safe for concurrent use.
+type VehicleState struct {
+	// Updated is when a register was last folded in.
+	Updated time.Time `json:"updated"`
+
+	VIN             *RegisterVIN             `json:"vin,omitempty"`
+	ECUVersion      *RegisterECUVersion      `json:"ecu_version,omitempty"`
+	Time            *RegisterTime            `json:"time,omitempty"`
+	BatteryLevel    *RegisterBatteryLevel    `json:"battery_level,omitempty"`
+	BatteryWarning  *RegisterBatteryWarning  `json:"battery_warning,omitempty"`
+	ChargePlug      *RegisterChargePlug      `json:"charge_plug,omitempty"`
+	ChargeStatus    *RegisterChargeStatus    `json:"charge_status,omitempty"`
+	ChargeSchedule  *RegisterChargeSchedule  `json:"charge_schedule,omitempty"`
+	Doors           *RegisterDoorStatus      `json:"doors,omitempty"`
+	Lights          *RegisterLightStatus     `json:"lights,omitempty"`
+	PreAC           *RegisterPreACState      `json:"pre_ac,omitempty"`
+	ACOperStatus    *RegisterACOperStatus    `json:"ac_oper_status,omitempty"`
+	ACMode          *RegisterACMode          `json:"ac_mode,omitempty"`
+	ClimateSchedule *RegisterClimateSchedule `json:"climate_schedule,omitempty"`
+	WIFISSID        *RegisterWIFISSID        `json:"wifi_ssid,omitempty"`
+	// Settings are merged from all settings registers, ordered by ID.
+	Settings []Setting `json:"settings,omitempty"`
+	// Other holds registers with no typed decoder, keyed by register
+	// number as "0x%02x".
+	Other map[string]*RegisterGeneric `json:"other,omitempty"`
+	// Defined holds registers decoded from definition files, keyed by
+	// definition name.
+	Defined map[string]*RegisterDefined `json:"defined,omitempty"`
+}
+
+// Update folds a decoded register into the state. Registers which
+// failed to decode, such as from an unexpected length, are ignored.
+func (s *VehicleState) Update(r Register) {
+	if r == nil || r.Raw() == "" {
+		return
+	}
+	switch reg := r.(type) {
+	case *RegisterVIN:
+		s.VIN = reg
+	case *RegisterECUVersion:
+		s.ECUVersion = reg
+	case *RegisterTime:
+		s.Time = reg
+	case *RegisterBatteryLevel:
+		s.BatteryLevel = reg
+	case *RegisterBatteryWarning:
+		s.BatteryWarning = reg
+	case *RegisterChargePlug:
+		s.ChargePlug = reg
+	case *RegisterChargeStatus:
+		s.ChargeStatus = reg
+	case *RegisterChargeSchedule:
+		s.ChargeSchedule = reg
+	case *RegisterDoorStatus:
+		s.Doors = reg
+	case *RegisterLightStatus:
+		s.Lights = reg
+	case *RegisterPreACState:
+		s.PreAC = reg
+	case *RegisterACOperStatus:
+		s.ACOperStatus = reg
+	case *RegisterACMode:
+		s.ACMode = reg
+	case *RegisterClimateSchedule:
+		s.ClimateSchedule = reg
+	case *RegisterWIFISSID:
+		s.WIFISSID = reg
+	case *RegisterSettings:
+		s.mergeSettings(reg.Settings)
+	case *RegisterGeneric:
+		if s.Other == nil {
+			s.Other = map[string]*RegisterGeneric{}
+		}
+		s.Other[fmt.Sprintf("0x%02x", reg.Register())] = reg
+	case *RegisterDefined:
+		if s.Defined == nil {
+			s.Defined = map[string]*RegisterDefined{}
+		}
+		s.Defined[reg.Definition.Name] = reg
+	default:
+		// Decoders installed with RegisterDecoder have no typed field.
+		return
+	}
+	s.Updated = time.Now()
+}
+
+// UpdateFromMessage folds in the register carried by a message, if any.
+func (s *VehicleState) UpdateFromMessage(m *PhevMessage) {
+	if m.Type == CmdInResp && m.Ack == Request && m.Reg != nil {
+		s.Update(m.Reg)
+	}
+}
+
+func (s *VehicleState) mergeSettings(settings []Setting) {
+	for _, n := range settings {
+		found := false
+		for i, v := range s.Settings {
+			if v.ID == n.ID {
+				s.Settings[i] = n
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.Settings = append(s.Settings, n)
+		}
+	}
+	sort.Slice(s.Settings, func(i, j int) bool { return s.Settings[i].ID < s.Settings[j].ID })
+}
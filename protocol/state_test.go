@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+func TestVehicleStateJSON(t *testing.T) {
+	s := &VehicleState{}
+	for _, m := range []struct {
+		register byte
+		data     string
+	}{
+		{BatteryLevelRegister, "50000100"},
+		{DoorStatusRegister, "01000001000000000000"},
+		{ACOperStatusRegister, "0401000000"},
+		{PreACStateRegister, "02b00b"},
+		{SettingsRegister, "026b0e2c002d0000"},
+		{ClimateScheduleRegister, "0204c0021d7a0200fe0700fe0700fe07"},
+		{0x99, "0102"},
+		// Wrong length, so not folded in.
+		{ChargeStatusRegister, "01"},
+	} {
+		data, err := hex.DecodeString(m.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := &PhevMessage{Type: CmdInResp, Ack: Request, Register: m.register, Data: data}
+		msg.Reg = NewRegister(m.register, ModelYearUnknown)
+		msg.Reg.Decode(msg)
+		s.UpdateFromMessage(msg)
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		path []string
+		want interface{}
+	}{
+		{[]string{"battery_level", "level"}, 80.0},
+		{[]string{"battery_level", "parking_lights"}, true},
+		{[]string{"battery_level", "register"}, "0x1d"},
+		{[]string{"battery_level", "raw"}, "50000100"},
+		{[]string{"doors", "locked"}, true},
+		{[]string{"doors", "driver"}, true},
+		{[]string{"ac_oper_status", "ignition"}, "on"},
+		{[]string{"pre_ac", "state"}, "on"},
+		{[]string{"other", "0x99", "raw"}, "0102"},
+	}
+	for _, c := range checks {
+		var v interface{} = got
+		for _, p := range c.path {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				t.Fatalf("%v: not an object in %s", c.path, b)
+			}
+			v = m[p]
+		}
+		if v != c.want {
+			t.Errorf("%v got=%v want=%v", c.path, v, c.want)
+		}
+	}
+	if _, ok := got["charge_status"]; ok {
+		t.Errorf("charge_status present after bad decode: %s", b)
+	}
+
+	timers := got["climate_schedule"].(map[string]interface{})["timers"].([]interface{})
+	second := timers[1].(map[string]interface{})
+	if days := second["days"].([]interface{}); len(days) != 3 || days[0] != "Sunday" || days[2] != "Tuesday" {
+		t.Errorf("timer 2 days got=%v", days)
+	}
+
+	settings := got["settings"].([]interface{})
+	if name := settings[0].(map[string]interface{})["value_name"]; name != "parking" {
+		t.Errorf("settings[0] value_name got=%v want=parking", name)
+	}
+}
@@ -157,6 +157,7 @@ phev_start_timeout=20s
 phev_register_timeout=10s
 phev_tcp_read_timeout=30s
 phev_tcp_write_timeout=15s
+phev_time_sync_threshold=0
 # Error Handling
 encoding_error_reset_interval=15s
 # Configuration Reload
@@ -215,6 +216,7 @@ export CONNECT_phev_start_timeout=$phev_start_timeout
 export CONNECT_phev_register_timeout=$phev_register_timeout
 export CONNECT_phev_tcp_read_timeout=$phev_tcp_read_timeout
 export CONNECT_phev_tcp_write_timeout=$phev_tcp_write_timeout
+export CONNECT_phev_time_sync_threshold=$phev_time_sync_threshold
 export CONNECT_encoding_error_reset_interval=$encoding_error_reset_interval
 export CONNECT_config_reload_interval=$config_reload_interval
 
@@ -305,6 +307,7 @@ else
     [[ -n "$CONNECT_phev_register_timeout" ]] && CMD_ARGS+=(--phev_register_timeout "$CONNECT_phev_register_timeout")
     [[ -n "$CONNECT_phev_tcp_read_timeout" ]] && CMD_ARGS+=(--phev_tcp_read_timeout "$CONNECT_phev_tcp_read_timeout")
     [[ -n "$CONNECT_phev_tcp_write_timeout" ]] && CMD_ARGS+=(--phev_tcp_write_timeout "$CONNECT_phev_tcp_write_timeout")
+    [[ -n "$CONNECT_phev_time_sync_threshold" ]] && CMD_ARGS+=(--phev_time_sync_threshold "$CONNECT_phev_time_sync_threshold")
     [[ -n "$CONNECT_encoding_error_reset_interval" ]] && CMD_ARGS+=(--encoding_error_reset_interval "$CONNECT_encoding_error_reset_interval")
     [[ -n "$CONNECT_config_reload_interval" ]] && CMD_ARGS+=(--config_reload_interval "$CONNECT_config_reload_interval")    
     [[ -n "$CONNECT_extra_add" ]] && CMD_ARGS+=($CONNECT_extra_add)